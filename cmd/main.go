@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/jackietana/crud-app/internal/config"
 	"github.com/jackietana/crud-app/internal/repository/psql"
 	"github.com/jackietana/crud-app/internal/service"
 	grpc_client "github.com/jackietana/crud-app/internal/transport/grpc"
 	"github.com/jackietana/crud-app/internal/transport/rest"
+	"github.com/jackietana/crud-app/migrations"
+	"github.com/jackietana/crud-app/pkg/cache"
 	"github.com/jackietana/crud-app/pkg/database"
 	"github.com/jackietana/crud-app/pkg/hash"
+	"github.com/jackietana/crud-app/pkg/metrics"
+	"github.com/jackietana/crud-app/pkg/migrate"
+	"github.com/jackietana/crud-app/pkg/tracing"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -38,28 +49,317 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(cfg, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// init tracing
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Config{
+		Enabled:      cfg.Tracing.Enabled,
+		ServiceName:  cfg.Tracing.ServiceName,
+		SampleRatio:  cfg.Tracing.SampleRatio,
+		OTLPEndpoint: cfg.Tracing.OTLP.Endpoint,
+		OTLPInsecure: cfg.Tracing.OTLP.Insecure,
+		Stdout:       cfg.Tracing.Stdout.Enabled,
+		File:         cfg.Tracing.Stdout.File,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// init db connection
 	db, err := database.ConnectDB(&cfg.DB)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+
+	// instances starting together take turns, the later ones find
+	// nothing left to apply
+	if cfg.Migrations.Auto {
+		migrator, err := migrate.New(db, migrations.FS)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := migrator.Up(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	//init dependencies
+	appMetrics := metrics.New()
+	appMetrics.RegisterDB(db, cfg.DB.Name)
+
 	bookRepo := psql.NewBookRepo(db)
 	userRepo := psql.NewUserRepo(db)
 	tokenRepo := psql.NewTokenRepo(db)
-	hasher := hash.NewSHA1Hasher(cfg.Salt)
-	loggerClient, err := grpc_client.NewClient(9000)
+	denylistRepo := psql.NewDenylistRepo(db)
+	outboxRepo := psql.NewOutboxRepo(db)
+	hasher := newPasswordHasher(cfg)
+	readinessChecks := map[string]rest.HealthChecker{
+		"postgres": rest.HealthCheckFunc(db.PingContext),
+	}
+
+	bookCache, err := newBookCache(cfg, appMetrics)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	bookService := service.NewBookService(bookRepo)
-	userService := service.NewUserService(userRepo, tokenRepo, hasher, loggerClient, cfg.Secret, cfg.Auth.TokenTTL, cfg.Auth.RefreshTTL)
-	handler := rest.NewHandler(bookService, userService)
+	if checker, ok := bookCache.(rest.HealthChecker); ok {
+		readinessChecks["cache"] = checker
+	}
+
+	loggerClient, err := newLoggerClient(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if checker, ok := loggerClient.(rest.HealthChecker); ok {
+		readinessChecks["grpc_logger"] = checker
+	}
+
+	auditDispatcher, err := grpc_client.NewDispatcher(loggerClient, grpc_client.DispatcherConfig{
+		QueueSize:        cfg.Audit.QueueSize,
+		BatchSize:        cfg.Audit.BatchSize,
+		FlushInterval:    cfg.Audit.FlushInterval,
+		SendTimeout:      cfg.Audit.SendTimeout,
+		MaxRetries:       cfg.Audit.MaxRetries,
+		RetryBaseDelay:   cfg.Audit.RetryBaseDelay,
+		RetryMaxDelay:    cfg.Audit.RetryMaxDelay,
+		BreakerThreshold: cfg.Audit.BreakerThreshold,
+		BreakerCooldown:  cfg.Audit.BreakerCooldown,
+		SpoolFile:        cfg.Audit.SpoolFile,
+	}, appMetrics)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// book and user changes are audited through the outbox; it needs
+	// delivery acknowledged, so it sends to the logger directly
+	outboxRelay := service.NewOutboxRelay(outboxRepo, service.OutboxConfig{
+		PollInterval:   cfg.Outbox.PollInterval,
+		BatchSize:      cfg.Outbox.BatchSize,
+		Lease:          cfg.Outbox.Lease,
+		SendTimeout:    cfg.Outbox.SendTimeout,
+		RetryBaseDelay: cfg.Outbox.RetryBaseDelay,
+		RetryMaxDelay:  cfg.Outbox.RetryMaxDelay,
+		StuckAfter:     cfg.Outbox.StuckAfter,
+		Retention:      cfg.Outbox.Retention,
+	}, appMetrics, loggerClient)
+
+	bookService := service.NewBookService(bookRepo, bookCache, auditDispatcher, appMetrics, cfg.Audit.Reads)
+	userService := service.NewUserService(userRepo, tokenRepo, denylistRepo, hasher, auditDispatcher, appMetrics, cfg.Secret, cfg.Auth.TokenTTL, cfg.Auth.RefreshTTL)
+	trashPurger := service.NewTrashPurger(bookService, service.TrashConfig{
+		Retention:     cfg.Trash.Retention,
+		PurgeInterval: cfg.Trash.PurgeInterval,
+		PurgeTimeout:  cfg.Trash.PurgeTimeout,
+	})
+
+	cacheInvalidator, err := newCacheInvalidator(cfg, bookService)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bookImporter := service.NewBookImporter(bookService, service.ImportConfig{
+		BatchSize: cfg.Import.BatchSize,
+		MaxErrors: cfg.Import.MaxErrors,
+		JobTTL:    cfg.Import.JobTTL,
+	})
+
+	handler := rest.NewHandler(bookService, bookImporter, userService, outboxRelay, appMetrics, readinessChecks,
+		rest.Options{
+			RequireIfMatch:       cfg.Server.RequireIfMatch,
+			ImportMaxSize:        cfg.Import.MaxSize,
+			ImportAsyncThreshold: cfg.Import.AsyncThreshold,
+		})
 
 	//init and run server
-	r := handler.InitRouter()
-	log.Fatal(r.Run(fmt.Sprintf(":%d", cfg.Server.Port)))
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler: handler.InitRouter(),
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	log.WithField("port", cfg.Server.Port).Info("Server started")
+
+	grpcServer := grpc_client.NewServer(cfg.GRPC.Port, bookService, userService, cfg.Server.RequireIfMatch)
+
+	go func() {
+		if err := grpcServer.ListenAndServe(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	log.WithField("port", cfg.GRPC.Port).Info("gRPC server started")
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Info("Shutting down")
+	handler.MarkShuttingDown()
+
+	// drain in-flight requests first, they may still use the logger and the db
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.WithField("shutdown", "http server").Error(err)
+	}
+
+	if err := grpcServer.Shutdown(shutdownCtx); err != nil {
+		log.WithField("shutdown", "grpc server").Error(err)
+	}
+
+	// running imports roll back, they can be sent again
+	if err := bookImporter.Close(shutdownCtx); err != nil {
+		log.WithField("shutdown", "book importer").Error(err)
+	}
+
+	if cacheInvalidator != nil {
+		if err := cacheInvalidator.Close(shutdownCtx); err != nil {
+			log.WithField("shutdown", "cache invalidator").Error(err)
+		}
+	}
+
+	if err := trashPurger.Close(shutdownCtx); err != nil {
+		log.WithField("shutdown", "trash purger").Error(err)
+	}
+
+	// queued audit events are sent or spooled before the connection goes away
+	if err := auditDispatcher.Close(shutdownCtx); err != nil {
+		log.WithField("shutdown", "audit dispatcher").Error(err)
+	}
+
+	if err := outboxRelay.Close(shutdownCtx); err != nil {
+		log.WithField("shutdown", "outbox relay").Error(err)
+	}
+
+	if err := loggerClient.CloseConnection(); err != nil {
+		log.WithField("shutdown", "grpc logger").Error(err)
+	}
+
+	if closer, ok := bookCache.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.WithField("shutdown", "cache").Error(err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		log.WithField("shutdown", "postgres").Error(err)
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.WithField("shutdown", "tracing").Error(err)
+	}
+
+	log.Info("Server stopped")
+}
+
+type auditLogger interface {
+	service.LoggerClient
+	CloseConnection() error
+}
+
+// newLoggerClient connects to the gRPC logger, or drops audit events
+// when the logger is disabled.
+func newLoggerClient(cfg *config.Config) (auditLogger, error) {
+	if !cfg.GRPCLogger.Enabled {
+		log.Warn("gRPC logger is disabled, audit events are dropped")
+		return grpc_client.NopClient{}, nil
+	}
+
+	return grpc_client.NewClient(grpc_client.Config{
+		Address: cfg.GRPCLogger.Address,
+		Timeout: cfg.GRPCLogger.Timeout,
+		Token:   cfg.GRPCLogger.Token,
+		TLS: grpc_client.TLSConfig{
+			Enabled:    cfg.GRPCLogger.TLS.Enabled,
+			CAFile:     cfg.GRPCLogger.TLS.CAFile,
+			CertFile:   cfg.GRPCLogger.TLS.CertFile,
+			KeyFile:    cfg.GRPCLogger.TLS.KeyFile,
+			ServerName: cfg.GRPCLogger.TLS.ServerName,
+		},
+		Keepalive: grpc_client.KeepaliveConfig{
+			Time:                cfg.GRPCLogger.Keepalive.Time,
+			Timeout:             cfg.GRPCLogger.Keepalive.Timeout,
+			PermitWithoutStream: cfg.GRPCLogger.Keepalive.PermitWithoutStream,
+		},
+	})
+}
+
+// newBookCache builds the configured cache backend. Replicas share the
+// redis backend, the memory backend is per instance.
+func newBookCache(cfg *config.Config, metrics cache.Metrics) (service.BookCache, error) {
+	switch cfg.Cache.Backend {
+	case "memory":
+		return cache.NewCacheHandler(cache.MemoryConfig{
+			BookTTL:    cfg.Cache.TTL,
+			ListTTL:    cfg.Cache.ListTTL,
+			Policy:     cfg.Cache.Policy,
+			MaxEntries: cfg.Cache.MaxEntries,
+			MaxBytes:   cfg.Cache.MaxBytes,
+		}, metrics)
+	case "redis":
+		return cache.NewRedisCache(cache.RedisConfig{
+			Address:   cfg.Cache.Redis.Address,
+			Password:  cfg.Cache.Redis.Password,
+			DB:        cfg.Cache.Redis.DB,
+			KeyPrefix: cfg.Cache.Redis.KeyPrefix,
+			BookTTL:   cfg.Cache.TTL,
+			ListTTL:   cfg.Cache.ListTTL,
+			Timeout:   cfg.Cache.Redis.Timeout,
+		}, metrics), nil
+	case "none":
+		log.Warn("Book cache is disabled")
+		return cache.NopCache{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown cache backend %q", cfg.Cache.Backend)
+}
+
+// newCacheInvalidator listens for book changes made through other
+// instances. Only the memory backend needs it, the others are shared or
+// hold nothing.
+func newCacheInvalidator(cfg *config.Config, books *service.BookService) (*service.CacheInvalidator, error) {
+	if cfg.Cache.Backend != "memory" || !cfg.Cache.Notify.Enabled {
+		return nil, nil
+	}
+
+	listener, err := psql.NewBookListener(database.ConnString(&cfg.DB), psql.ListenerConfig{
+		MinReconnect: cfg.Cache.Notify.MinReconnect,
+		MaxReconnect: cfg.Cache.Notify.MaxReconnect,
+		PingInterval: cfg.Cache.Notify.PingInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return service.NewCacheInvalidator(books, listener), nil
+}
+
+// newPasswordHasher hashes with the configured algorithm and still verifies
+// hashes of the other schemes, including legacy SHA1, so they are upgraded on sign in.
+func newPasswordHasher(cfg *config.Config) *hash.PasswordHasher {
+	bcrypt := hash.NewBcryptHasher(cfg.Hash.BcryptCost)
+	argon2 := hash.NewArgon2idHasher(hash.Argon2Params{
+		Memory:     cfg.Hash.Argon2.Memory,
+		Iterations: cfg.Hash.Argon2.Iterations,
+		Threads:    cfg.Hash.Argon2.Threads,
+	})
+	sha1 := hash.NewSHA1Hasher(cfg.Salt)
+
+	if cfg.Hash.Algorithm == "bcrypt" {
+		return hash.NewPasswordHasher(bcrypt, argon2, sha1)
+	}
+
+	return hash.NewPasswordHasher(argon2, bcrypt, sha1)
 }
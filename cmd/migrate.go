@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/jackietana/crud-app/internal/config"
+	"github.com/jackietana/crud-app/migrations"
+	"github.com/jackietana/crud-app/pkg/database"
+	"github.com/jackietana/crud-app/pkg/migrate"
+)
+
+var errMigrateUsage = errors.New("usage: crud-app migrate up|down|status|goto N")
+
+// runMigrate runs the migrate subcommand: up applies every pending
+// migration, down reverts the last one, goto N applies or reverts
+// migrations until N is the last applied, status lists them.
+func runMigrate(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errMigrateUsage
+	}
+
+	db, err := database.ConnectDB(&cfg.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		return migrator.Up(ctx)
+	case args[0] == "down" && len(args) == 1:
+		return migrator.Down(ctx)
+	case args[0] == "status" && len(args) == 1:
+		return printMigrationStatus(ctx, migrator)
+	case args[0] == "goto" && len(args) == 2:
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errMigrateUsage
+		}
+		return migrator.Goto(ctx, version)
+	}
+
+	return errMigrateUsage
+}
+
+func printMigrationStatus(ctx context.Context, migrator *migrate.Migrator) error {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, s := range statuses {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		if s.Up == "" {
+			applied += " (unknown to this binary)"
+		}
+		fmt.Fprintf(w, "%03d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+
+	return w.Flush()
+}
@@ -13,13 +13,131 @@ type Config struct {
 	Secret []byte
 
 	Server struct {
-		Port int `mapstructure:"port"`
+		Port            int           `mapstructure:"port"`
+		ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+		RequireIfMatch  bool          `mapstructure:"require_if_match"`
 	} `mapstructure:"server"`
 
+	GRPC struct {
+		Port int `mapstructure:"port"`
+	} `mapstructure:"grpc"`
+
+	Migrations struct {
+		Auto bool `mapstructure:"auto"`
+	} `mapstructure:"migrations"`
+
 	Auth struct {
 		TokenTTL   time.Duration `mapstructure:"token_ttl"`
 		RefreshTTL time.Duration `mapstructure:"refresh_ttl"`
 	} `mapstructure:"auth"`
+
+	GRPCLogger struct {
+		Enabled bool          `mapstructure:"enabled"`
+		Address string        `mapstructure:"address"`
+		Timeout time.Duration `mapstructure:"timeout"`
+		Token   string        `mapstructure:"token"`
+		TLS     struct {
+			Enabled    bool   `mapstructure:"enabled"`
+			CAFile     string `mapstructure:"ca_file"`
+			CertFile   string `mapstructure:"cert_file"`
+			KeyFile    string `mapstructure:"key_file"`
+			ServerName string `mapstructure:"server_name"`
+		} `mapstructure:"tls"`
+		Keepalive struct {
+			Time                time.Duration `mapstructure:"time"`
+			Timeout             time.Duration `mapstructure:"timeout"`
+			PermitWithoutStream bool          `mapstructure:"permit_without_stream"`
+		} `mapstructure:"keepalive"`
+	} `mapstructure:"grpc_logger"`
+
+	Audit struct {
+		Reads bool `mapstructure:"reads"`
+
+		QueueSize     int           `mapstructure:"queue_size"`
+		BatchSize     int           `mapstructure:"batch_size"`
+		FlushInterval time.Duration `mapstructure:"flush_interval"`
+		SendTimeout   time.Duration `mapstructure:"send_timeout"`
+
+		MaxRetries     int           `mapstructure:"max_retries"`
+		RetryBaseDelay time.Duration `mapstructure:"retry_base_delay"`
+		RetryMaxDelay  time.Duration `mapstructure:"retry_max_delay"`
+
+		BreakerThreshold int           `mapstructure:"breaker_threshold"`
+		BreakerCooldown  time.Duration `mapstructure:"breaker_cooldown"`
+
+		SpoolFile string `mapstructure:"spool_file"`
+	} `mapstructure:"audit"`
+
+	Outbox struct {
+		PollInterval   time.Duration `mapstructure:"poll_interval"`
+		BatchSize      int           `mapstructure:"batch_size"`
+		Lease          time.Duration `mapstructure:"lease"`
+		SendTimeout    time.Duration `mapstructure:"send_timeout"`
+		RetryBaseDelay time.Duration `mapstructure:"retry_base_delay"`
+		RetryMaxDelay  time.Duration `mapstructure:"retry_max_delay"`
+		StuckAfter     time.Duration `mapstructure:"stuck_after"`
+		Retention      time.Duration `mapstructure:"retention"`
+	} `mapstructure:"outbox"`
+
+	Trash struct {
+		Retention     time.Duration `mapstructure:"retention"`
+		PurgeInterval time.Duration `mapstructure:"purge_interval"`
+		PurgeTimeout  time.Duration `mapstructure:"purge_timeout"`
+	} `mapstructure:"trash"`
+
+	Import struct {
+		BatchSize      int           `mapstructure:"batch_size"`
+		MaxErrors      int           `mapstructure:"max_errors"`
+		MaxSize        int64         `mapstructure:"max_size"`
+		AsyncThreshold int64         `mapstructure:"async_threshold"`
+		JobTTL         time.Duration `mapstructure:"job_ttl"`
+	} `mapstructure:"import"`
+
+	Cache struct {
+		Backend    string        `mapstructure:"backend"`
+		TTL        time.Duration `mapstructure:"ttl"`
+		ListTTL    time.Duration `mapstructure:"list_ttl"`
+		Policy     string        `mapstructure:"policy"`
+		MaxEntries int           `mapstructure:"max_entries"`
+		MaxBytes   int64         `mapstructure:"max_bytes"`
+		Redis      struct {
+			Address   string        `mapstructure:"address"`
+			Password  string        `mapstructure:"password"`
+			DB        int           `mapstructure:"db"`
+			KeyPrefix string        `mapstructure:"key_prefix"`
+			Timeout   time.Duration `mapstructure:"timeout"`
+		} `mapstructure:"redis"`
+		Notify struct {
+			Enabled      bool          `mapstructure:"enabled"`
+			MinReconnect time.Duration `mapstructure:"min_reconnect"`
+			MaxReconnect time.Duration `mapstructure:"max_reconnect"`
+			PingInterval time.Duration `mapstructure:"ping_interval"`
+		} `mapstructure:"notify"`
+	} `mapstructure:"cache"`
+
+	Tracing struct {
+		Enabled     bool    `mapstructure:"enabled"`
+		ServiceName string  `mapstructure:"service_name"`
+		SampleRatio float64 `mapstructure:"sample_ratio"`
+		OTLP        struct {
+			Endpoint string `mapstructure:"endpoint"`
+			Insecure bool   `mapstructure:"insecure"`
+		} `mapstructure:"otlp"`
+		Stdout struct {
+			Enabled bool   `mapstructure:"enabled"`
+			File    string `mapstructure:"file"`
+		} `mapstructure:"stdout"`
+	} `mapstructure:"tracing"`
+
+	Hash struct {
+		Algorithm  string `mapstructure:"algorithm"`
+		BcryptCost int    `mapstructure:"bcrypt_cost"`
+		Argon2     struct {
+			Memory     uint32 `mapstructure:"memory"`
+			Iterations uint32 `mapstructure:"iterations"`
+			Threads    uint8  `mapstructure:"threads"`
+		} `mapstructure:"argon2"`
+	} `mapstructure:"hash"`
 }
 
 type Postgres struct {
@@ -53,32 +171,96 @@ func (c *Config) getField(field string) string {
 	return ""
 }
 
-func (c *Config) getSalt() error {
-	c.Salt = c.getField("hash_salt")
-
+// getSalt reads the salt of legacy SHA1 password hashes. Those were made
+// while jwt_secret overwrote hash_salt as the config was read, so they are
+// salted with the JWT secret unless legacy_hash_salt says otherwise.
+func (c *Config) getSalt() {
+	c.Salt = c.getField("legacy_hash_salt")
 	if c.Salt == "" {
-		return errors.New("unable to retrieve salt")
+		c.Salt = string(c.Secret)
 	}
-
-	return nil
 }
 
 func (c *Config) getSecret() error {
-	c.Salt = c.getField("jwt_secret")
+	c.Secret = []byte(c.getField("jwt_secret"))
 
-	if c.Salt == "" {
+	if len(c.Secret) == 0 {
 		return errors.New("unable to retrieve secret")
 	}
 
 	return nil
 }
 
+// getLoggerToken lets the logger token come from the environment,
+// so it does not have to be kept in the config file.
+func (c *Config) getLoggerToken() {
+	if token := c.getField("grpc_logger_token"); token != "" {
+		c.GRPCLogger.Token = token
+	}
+}
+
+// getRedisPassword lets the Redis password come from the environment,
+// like the logger token.
+func (c *Config) getRedisPassword() {
+	if password := c.getField("redis_password"); password != "" {
+		c.Cache.Redis.Password = password
+	}
+}
+
 func New(dir, file string) (*Config, error) {
 	cfg := new(Config)
 
 	viper.AddConfigPath(dir)
 	viper.SetConfigName(file)
 	viper.AutomaticEnv()
+	viper.SetDefault("server.shutdown_timeout", 15*time.Second)
+	viper.SetDefault("server.require_if_match", false)
+	viper.SetDefault("grpc.port", 9090)
+	viper.SetDefault("migrations.auto", false)
+	viper.SetDefault("grpc_logger.enabled", true)
+	viper.SetDefault("grpc_logger.address", "localhost:9000")
+	viper.SetDefault("grpc_logger.timeout", 5*time.Second)
+	viper.SetDefault("grpc_logger.keepalive.timeout", 20*time.Second)
+	viper.SetDefault("audit.queue_size", 1024)
+	viper.SetDefault("audit.batch_size", 50)
+	viper.SetDefault("audit.flush_interval", time.Second)
+	viper.SetDefault("audit.send_timeout", 5*time.Second)
+	viper.SetDefault("audit.max_retries", 3)
+	viper.SetDefault("audit.retry_base_delay", 200*time.Millisecond)
+	viper.SetDefault("audit.retry_max_delay", 5*time.Second)
+	viper.SetDefault("audit.breaker_threshold", 5)
+	viper.SetDefault("audit.breaker_cooldown", 30*time.Second)
+	viper.SetDefault("outbox.poll_interval", time.Second)
+	viper.SetDefault("outbox.batch_size", 100)
+	viper.SetDefault("outbox.lease", 30*time.Second)
+	viper.SetDefault("outbox.send_timeout", 5*time.Second)
+	viper.SetDefault("outbox.retry_base_delay", time.Second)
+	viper.SetDefault("outbox.retry_max_delay", 5*time.Minute)
+	viper.SetDefault("outbox.stuck_after", 5*time.Minute)
+	viper.SetDefault("outbox.retention", 7*24*time.Hour)
+	viper.SetDefault("trash.retention", 30*24*time.Hour)
+	viper.SetDefault("trash.purge_interval", time.Hour)
+	viper.SetDefault("trash.purge_timeout", time.Minute)
+	viper.SetDefault("import.batch_size", 500)
+	viper.SetDefault("import.max_errors", 100)
+	viper.SetDefault("import.max_size", 100<<20)
+	viper.SetDefault("import.async_threshold", 10<<20)
+	viper.SetDefault("import.job_ttl", 24*time.Hour)
+	viper.SetDefault("cache.backend", "memory")
+	viper.SetDefault("cache.ttl", 8*time.Hour)
+	viper.SetDefault("cache.list_ttl", 8*time.Hour)
+	viper.SetDefault("cache.policy", "lru")
+	viper.SetDefault("cache.max_entries", 10000)
+	viper.SetDefault("cache.max_bytes", 64<<20)
+	viper.SetDefault("cache.redis.address", "localhost:6379")
+	viper.SetDefault("cache.redis.key_prefix", "crud-app:")
+	viper.SetDefault("cache.redis.timeout", 500*time.Millisecond)
+	viper.SetDefault("cache.notify.enabled", true)
+	viper.SetDefault("cache.notify.min_reconnect", time.Second)
+	viper.SetDefault("cache.notify.max_reconnect", time.Minute)
+	viper.SetDefault("cache.notify.ping_interval", 90*time.Second)
+	viper.SetDefault("tracing.service_name", "crud-app")
+	viper.SetDefault("tracing.sample_ratio", 1.0)
 
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, err
@@ -92,13 +274,14 @@ func New(dir, file string) (*Config, error) {
 		return nil, err
 	}
 
-	if err := cfg.getSalt(); err != nil {
-		return nil, err
-	}
-
 	if err := cfg.getSecret(); err != nil {
 		return nil, err
 	}
 
+	cfg.getSalt()
+
+	cfg.getLoggerToken()
+	cfg.getRedisPassword()
+
 	return cfg, nil
 }
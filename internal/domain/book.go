@@ -1,6 +1,33 @@
 package domain
 
-import "time"
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultBooksLimit = 20
+	MaxBooksLimit     = 100
+
+	GenresMatchAny = "any"
+	GenresMatchAll = "all"
+
+	SortAsc  = "asc"
+	SortDesc = "desc"
+)
+
+// BookSortFields lists the book fields GET /books can be ordered by.
+var BookSortFields = map[string]bool{
+	"id":           true,
+	"name":         true,
+	"description":  true,
+	"author":       true,
+	"is_free":      true,
+	"published_at": true,
+}
 
 type Book struct {
 	ID          int       `json:"id"`
@@ -10,4 +37,148 @@ type Book struct {
 	IsFree      bool      `json:"is_free" binding:"required"`
 	Genres      []string  `json:"genres" binding:"required"`
 	PublishedAt time.Time `json:"published_at"`
+	Version     int       `json:"version"`
+	// DeletedAt is set while the book is in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Validate checks that a book has the fields a full update requires.
+func (b Book) Validate() error {
+	if strings.TrimSpace(b.Name) == "" || strings.TrimSpace(b.Description) == "" ||
+		strings.TrimSpace(b.Author) == "" || b.Genres == nil {
+		return ErrInvalidBook
+	}
+
+	return nil
+}
+
+// BookQuery describes a filtered, sorted and paginated books listing.
+// Cursor takes precedence over Offset when both are set.
+type BookQuery struct {
+	Limit  int
+	Offset int
+	Cursor string
+
+	Author        string
+	Genres        []string
+	GenresMatch   string
+	IsFree        *bool
+	PublishedFrom *time.Time
+	PublishedTo   *time.Time
+
+	SortBy    string
+	SortOrder string
+}
+
+type BookPage struct {
+	Books      []Book `json:"items"`
+	Total      int    `json:"total"`
+	Limit      int    `json:"limit"`
+	Offset     int    `json:"offset"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Normalize fills in defaults and validates the query.
+func (q *BookQuery) Normalize() error {
+	if q.Limit <= 0 {
+		q.Limit = DefaultBooksLimit
+	}
+	if q.Limit > MaxBooksLimit {
+		q.Limit = MaxBooksLimit
+	}
+	if q.Offset < 0 {
+		return ErrInvalidBookQuery
+	}
+
+	if q.GenresMatch == "" {
+		q.GenresMatch = GenresMatchAny
+	}
+	if q.GenresMatch != GenresMatchAny && q.GenresMatch != GenresMatchAll {
+		return ErrInvalidBookQuery
+	}
+
+	if q.SortBy == "" {
+		q.SortBy = "id"
+	}
+	if !BookSortFields[q.SortBy] {
+		return ErrInvalidBookQuery
+	}
+
+	if q.SortOrder == "" {
+		q.SortOrder = SortAsc
+	}
+	if q.SortOrder != SortAsc && q.SortOrder != SortDesc {
+		return ErrInvalidBookQuery
+	}
+
+	if q.PublishedFrom != nil && q.PublishedTo != nil && q.PublishedFrom.After(*q.PublishedTo) {
+		return ErrInvalidBookQuery
+	}
+
+	return nil
+}
+
+// CacheKey identifies the listing a normalized query selects, it is
+// equal for equivalent queries.
+func (q BookQuery) CacheKey() string {
+	genres := append([]string(nil), q.Genres...)
+	sort.Strings(genres)
+
+	var isFree, from, to string
+	if q.IsFree != nil {
+		isFree = strconv.FormatBool(*q.IsFree)
+	}
+	if q.PublishedFrom != nil {
+		from = q.PublishedFrom.UTC().Format(time.RFC3339Nano)
+	}
+	if q.PublishedTo != nil {
+		to = q.PublishedTo.UTC().Format(time.RFC3339Nano)
+	}
+
+	return fmt.Sprintf("books_%d_%d_%s_%s_%s_%s_%s_%s_%s_%s_%s",
+		q.Limit, q.Offset, q.Cursor, strings.ToLower(q.Author), strings.Join(genres, ","), q.GenresMatch,
+		isFree, from, to, q.SortBy, q.SortOrder)
+}
+
+// BookSearchQuery is a full-text search over book name, author and description.
+type BookSearchQuery struct {
+	Query  string
+	Limit  int
+	Offset int
+}
+
+// BookSearchResult is a book found by a search. The highlights and the
+// snippet are HTML: the book text escaped, with matches in <mark> tags.
+type BookSearchResult struct {
+	Book
+	Rank            float64 `json:"rank"`
+	NameHighlight   string  `json:"name_highlight"`
+	AuthorHighlight string  `json:"author_highlight"`
+	Snippet         string  `json:"snippet"`
+}
+
+type BookSearchPage struct {
+	Results []BookSearchResult `json:"items"`
+	Total   int                `json:"total"`
+	Limit   int                `json:"limit"`
+	Offset  int                `json:"offset"`
+}
+
+func (q *BookSearchQuery) Normalize() error {
+	q.Query = strings.TrimSpace(q.Query)
+	if q.Query == "" {
+		return ErrInvalidBookQuery
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = DefaultBooksLimit
+	}
+	if q.Limit > MaxBooksLimit {
+		q.Limit = MaxBooksLimit
+	}
+	if q.Offset < 0 {
+		return ErrInvalidBookQuery
+	}
+
+	return nil
 }
@@ -0,0 +1,16 @@
+package domain
+
+const (
+	BookChangeInsert = "insert"
+	BookChangeUpdate = "update"
+	BookChangeDelete = "delete"
+)
+
+// BookChange is a committed change to a book, announced by the database
+// to every instance. Missed stands for changes that may have gone
+// unannounced while the connection was down.
+type BookChange struct {
+	ID     int    `json:"id"`
+	Op     string `json:"op"`
+	Missed bool   `json:"-"`
+}
@@ -0,0 +1,19 @@
+package domain
+
+import "time"
+
+type BookEventType string
+
+const (
+	BookCreated BookEventType = "created"
+	BookUpdated BookEventType = "updated"
+	BookDeleted BookEventType = "deleted"
+)
+
+// BookEvent is a change to a book. Book is nil for deleted books.
+type BookEvent struct {
+	Type      BookEventType
+	ID        int
+	Book      *Book
+	Timestamp time.Time
+}
@@ -0,0 +1,101 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxBookFieldLength is the size of the name, description and author columns.
+const MaxBookFieldLength = 255
+
+const (
+	ImportModeInsert = "insert"
+	ImportModeUpsert = "upsert"
+
+	ImportJobRunning = "running"
+	ImportJobDone    = "done"
+	ImportJobFailed  = "failed"
+)
+
+// ImportOptions controls a bulk import. Upsert matches books by their
+// natural key, name and author compared case-insensitively, and updates
+// them instead of inserting duplicates. A dry run does all the work and
+// rolls it back.
+type ImportOptions struct {
+	Mode   string
+	DryRun bool
+}
+
+func (o *ImportOptions) Normalize() error {
+	if o.Mode == "" {
+		o.Mode = ImportModeInsert
+	}
+	if o.Mode != ImportModeInsert && o.Mode != ImportModeUpsert {
+		return fmt.Errorf("%w: mode must be %s or %s", ErrInvalidImport, ImportModeInsert, ImportModeUpsert)
+	}
+
+	return nil
+}
+
+// BookSource yields the rows of an import file. Next returns io.EOF after
+// the last row; any other error ends the import.
+type BookSource interface {
+	Next() (ImportRow, error)
+}
+
+// ImportRow is a book read from an import file. Line is the CSV or NDJSON
+// line, or the position in a JSON array. Err is set when the row could
+// not be read; the import goes on without it.
+type ImportRow struct {
+	Line int
+	Book Book
+	Err  error
+}
+
+type ImportRowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type ImportResult struct {
+	DryRun   bool `json:"dry_run"`
+	Rows     int  `json:"rows"`
+	Inserted int  `json:"inserted"`
+	Updated  int  `json:"updated"`
+	Failed   int  `json:"failed"`
+	// Errors lists the first failed rows, Failed counts all of them.
+	Errors []ImportRowError `json:"errors"`
+}
+
+// ImportJob is an import running in the background.
+type ImportJob struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Processed is the number of rows read so far.
+	Processed  int           `json:"processed"`
+	Result     *ImportResult `json:"result,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+// ValidateImport checks an imported book: the fields a full update
+// requires, within the column sizes.
+func (b Book) ValidateImport() error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+
+	if len(b.Genres) == 0 {
+		return ErrInvalidBook
+	}
+
+	fields := []struct{ name, value string }{{"name", b.Name}, {"description", b.Description}, {"author", b.Author}}
+	for _, f := range fields {
+		if len([]rune(f.value)) > MaxBookFieldLength {
+			return fmt.Errorf("%w: %s is longer than %d characters", ErrInvalidBook, f.name, MaxBookFieldLength)
+		}
+	}
+
+	return nil
+}
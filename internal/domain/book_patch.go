@@ -0,0 +1,43 @@
+package domain
+
+import "slices"
+
+// BookPatch holds the book fields a partial update changes, nil fields
+// are left as they are.
+type BookPatch struct {
+	Name        *string
+	Description *string
+	Author      *string
+	IsFree      *bool
+	Genres      []string
+	// GenresSet tells an update to empty genres from no change to them.
+	GenresSet bool
+}
+
+// NewBookPatch returns the changes that turn from into to.
+func NewBookPatch(from, to Book) BookPatch {
+	var p BookPatch
+
+	if from.Name != to.Name {
+		p.Name = &to.Name
+	}
+	if from.Description != to.Description {
+		p.Description = &to.Description
+	}
+	if from.Author != to.Author {
+		p.Author = &to.Author
+	}
+	if from.IsFree != to.IsFree {
+		p.IsFree = &to.IsFree
+	}
+	if !slices.Equal(from.Genres, to.Genres) {
+		p.Genres = to.Genres
+		p.GenresSet = true
+	}
+
+	return p
+}
+
+func (p BookPatch) Empty() bool {
+	return p.Name == nil && p.Description == nil && p.Author == nil && p.IsFree == nil && !p.GenresSet
+}
@@ -0,0 +1,84 @@
+package domain
+
+import (
+	"slices"
+	"time"
+)
+
+// Revision actions, the writes that produce a book revision.
+const (
+	RevisionCreated  = "created"
+	RevisionUpdated  = "updated"
+	RevisionDeleted  = "deleted"
+	RevisionRestored = "restored"
+	RevisionReverted = "reverted"
+	RevisionPurged   = "purged"
+)
+
+// BookRevision is a snapshot of a book taken by every write. Revision is
+// the book version the write produced; a purge, which leaves no book
+// behind, takes the version after the last one.
+type BookRevision struct {
+	BookID    int       `json:"book_id"`
+	Revision  int       `json:"revision"`
+	Action    string    `json:"action"`
+	Book      Book      `json:"book"`
+	ActorID   *int      `json:"actor_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type BookRevisionPage struct {
+	Revisions []BookRevision `json:"items"`
+	Total     int            `json:"total"`
+	Limit     int            `json:"limit"`
+	Offset    int            `json:"offset"`
+}
+
+// FieldChange is a book field that differs between two revisions, named
+// as in the JSON form of the book.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type BookDiff struct {
+	BookID  int           `json:"book_id"`
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// DiffBooks lists the fields that differ between two snapshots of a book.
+func DiffBooks(from, to Book) []FieldChange {
+	changes := make([]FieldChange, 0)
+
+	add := func(field string, a, b interface{}) {
+		changes = append(changes, FieldChange{Field: field, From: a, To: b})
+	}
+
+	if from.Name != to.Name {
+		add("name", from.Name, to.Name)
+	}
+	if from.Description != to.Description {
+		add("description", from.Description, to.Description)
+	}
+	if from.Author != to.Author {
+		add("author", from.Author, to.Author)
+	}
+	if from.IsFree != to.IsFree {
+		add("is_free", from.IsFree, to.IsFree)
+	}
+	if !slices.Equal(from.Genres, to.Genres) {
+		add("genres", from.Genres, to.Genres)
+	}
+	if !from.PublishedAt.Equal(to.PublishedAt) {
+		add("published_at", from.PublishedAt, to.PublishedAt)
+	}
+	if (from.DeletedAt == nil) != (to.DeletedAt == nil) ||
+		(from.DeletedAt != nil && !from.DeletedAt.Equal(*to.DeletedAt)) {
+		add("deleted_at", from.DeletedAt, to.DeletedAt)
+	}
+
+	return changes
+}
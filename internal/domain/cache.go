@@ -0,0 +1,16 @@
+package domain
+
+// CacheStats describes the book cache for operators. Counts are those of
+// this instance since it started. Sizes and limits are only known for the
+// memory backend.
+type CacheStats struct {
+	Backend    string            `json:"backend"`
+	Policy     string            `json:"policy,omitempty"`
+	Entries    int               `json:"entries"`
+	Bytes      int64             `json:"bytes"`
+	MaxEntries int               `json:"max_entries,omitempty"`
+	MaxBytes   int64             `json:"max_bytes,omitempty"`
+	Hits       uint64            `json:"hits"`
+	Misses     uint64            `json:"misses"`
+	Evictions  map[string]uint64 `json:"evictions"`
+}
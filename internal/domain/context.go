@@ -0,0 +1,18 @@
+package domain
+
+import "context"
+
+type ctxKey int
+
+const userIDKey ctxKey = iota
+
+// WithUserID returns a copy of ctx carrying the id of the acting user.
+func WithUserID(ctx context.Context, userId int) context.Context {
+	return context.WithValue(ctx, userIDKey, userId)
+}
+
+// UserIDFromContext returns the id of the acting user, if there is one.
+func UserIDFromContext(ctx context.Context) (int, bool) {
+	userId, ok := ctx.Value(userIDKey).(int)
+	return userId, ok
+}
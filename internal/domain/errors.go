@@ -4,6 +4,23 @@ import "errors"
 
 var (
 	ErrBookNotFound        = errors.New("book not found")
+	ErrBookNotInTrash      = errors.New("book is not in the trash")
+	ErrForbidden           = errors.New("forbidden")
+	ErrInvalidBook         = errors.New("invalid book: name, description, author and genres are required")
+	ErrInvalidBookQuery    = errors.New("invalid book query")
+	ErrInvalidCursor       = errors.New("invalid cursor")
+	ErrInvalidImport       = errors.New("invalid import")
+	ErrImportJobNotFound   = errors.New("import job not found")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrInvalidRole         = errors.New("invalid role")
+	ErrPreconditionMissing = errors.New("precondition required: send If-Match with the book ETag")
 	ErrRefreshTokenExpired = errors.New("session expired")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+	ErrRevisionNotFound    = errors.New("revision not found")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrSessionRevoked      = errors.New("session revoked")
+	ErrTokenCheckFailed    = errors.New("token revocation could not be checked")
+	ErrTokenRevoked        = errors.New("token revoked")
 	ErrUserNotFound        = errors.New("user not found")
+	ErrVersionMismatch     = errors.New("book was changed: ETag does not match")
 )
@@ -0,0 +1,24 @@
+package domain
+
+import "time"
+
+// OutboxEvent is an audit event stored in the same transaction as the
+// change it describes. A relay publishes it afterwards and sets SentAt.
+type OutboxEvent struct {
+	ID          int64      `json:"id"`
+	Entity      string     `json:"entity"`
+	Action      string     `json:"action"`
+	EntityID    int64      `json:"entity_id"`
+	ActorID     *int       `json:"actor_id,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	SentAt      *time.Time `json:"-"`
+}
+
+// OutboxStatus summarizes unsent events for operators.
+type OutboxStatus struct {
+	Pending int64         `json:"pending"`
+	Stuck   []OutboxEvent `json:"stuck"`
+}
@@ -2,9 +2,41 @@ package domain
 
 import "time"
 
+// RefreshToken belongs to a session. Tokens are single use: refreshing
+// marks the token used and issues the next one in the same session.
 type RefreshToken struct {
 	ID        int
+	SessionID int
 	UserID    int
-	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// Session is a sign in on a single device. All refresh tokens rotated
+// from the same sign in share the session, which makes it a token family.
+type Session struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"-"`
+	Current    bool       `json:"current"`
+}
+
+// SessionMeta describes the client a session was started or refreshed from.
+type SessionMeta struct {
+	UserAgent string
+	IP        string
+}
+
+// TokenClaims is what an access token says about its bearer.
+type TokenClaims struct {
+	ID        string
+	UserID    int
+	Role      Role
+	SessionID int
 	ExpiresAt time.Time
 }
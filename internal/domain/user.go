@@ -4,6 +4,30 @@ import (
 	"time"
 )
 
+type Role string
+
+const (
+	RoleReader Role = "reader"
+	RoleEditor Role = "editor"
+	RoleAdmin  Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleReader: 1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// Includes reports whether r grants at least the permissions of other.
+func (r Role) Includes(other Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[other]
+}
+
 type UserSignIn struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required,gte=5"`
@@ -14,5 +38,10 @@ type User struct {
 	Name         string    `json:"name" validate:"required,gte=2"`
 	Email        string    `json:"email" validate:"required,email"`
 	Password     string    `json:"password" validate:"required,gte=5"`
+	Role         Role      `json:"role"`
 	RegisteredAt time.Time `json:"registered_at"`
 }
+
+type UserRole struct {
+	Role Role `json:"role" binding:"required"`
+}
@@ -0,0 +1,70 @@
+package psql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportFetchSize is the number of rows taken from the export cursor at
+// a time.
+const exportFetchSize = 1000
+
+// ExportBooks calls fn with every book the query filters select, in the
+// query order. The rows are read through a server-side cursor, so only a
+// fetch worth of them is held at a time. Limit, offset and cursor of the
+// query are ignored.
+func (br *BookRepository) ExportBooks(ctx context.Context, q domain.BookQuery, fn func(domain.Book) error) error {
+	f := newBookFilter(q)
+	strQuery := fmt.Sprintf("SELECT %s FROM books%s ORDER BY %s %s, id %s",
+		bookColumns, f.clause(), q.SortBy, q.SortOrder, q.SortOrder)
+
+	var count int
+	err := br.db.withTx(ctx, func(tx tracedTx) error {
+		if _, err := tx.ExecContext(ctx, "DECLARE books_export NO SCROLL CURSOR FOR "+strQuery, f.args...); err != nil {
+			return err
+		}
+
+		for {
+			n, err := fetchBooks(ctx, tx, fn)
+			if err != nil {
+				return err
+			}
+
+			count += n
+			if n < exportFetchSize {
+				return nil
+			}
+		}
+	})
+
+	log.WithField("count", count).Info("Repository: ExportBooks")
+
+	return err
+}
+
+func fetchBooks(ctx context.Context, tx tracedTx, fn func(domain.Book) error) (int, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("FETCH FORWARD %d FROM books_export", exportFetchSize))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return n, err
+		}
+
+		if err := fn(b); err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, rows.Err()
+}
@@ -0,0 +1,167 @@
+package psql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	logger "github.com/jackietana/grpc-logger/pkg/domain"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+// ImportBooks writes the batches next returns, until an empty one, in a
+// single transaction: the import is stored whole or not at all. In upsert
+// mode books already stored under the same name and author are updated.
+// It returns the ids of the inserted and of the updated books.
+func (br *BookRepository) ImportBooks(ctx context.Context, opts domain.ImportOptions,
+	next func() ([]domain.Book, error)) (inserted, updated []int, err error) {
+	err = br.db.withTx(ctx, func(tx tracedTx) error {
+		for {
+			batch, err := next()
+			if err != nil {
+				return err
+			}
+
+			if len(batch) == 0 {
+				break
+			}
+
+			inserts := batch
+			if opts.Mode == domain.ImportModeUpsert {
+				existing, err := findByNaturalKey(ctx, tx, batch)
+				if err != nil {
+					return err
+				}
+
+				inserts = make([]domain.Book, 0, len(batch))
+				for i, b := range batch {
+					id, ok := existing[i]
+					if !ok {
+						inserts = append(inserts, b)
+						continue
+					}
+
+					if _, err := updateBook(ctx, tx, id, b, 0, domain.RevisionUpdated); err != nil {
+						return err
+					}
+
+					updated = append(updated, id)
+				}
+			}
+
+			ids, err := insertBooks(ctx, tx, inserts)
+			if err != nil {
+				return err
+			}
+
+			inserted = append(inserted, ids...)
+		}
+
+		if opts.DryRun {
+			return errDryRun
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"inserted": len(inserted),
+		"updated":  len(updated),
+		"dry_run":  opts.DryRun,
+	}).Info("Repository: ImportBooks")
+
+	return inserted, updated, nil
+}
+
+// findByNaturalKey maps the positions of the batch books to the ids of
+// the stored books with the same name and author, the oldest one when
+// there are several.
+func findByNaturalKey(ctx context.Context, tx tracedTx, batch []domain.Book) (map[int]int, error) {
+	names := make([]string, len(batch))
+	authors := make([]string, len(batch))
+	for i, b := range batch {
+		names[i], authors[i] = b.Name, b.Author
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+SELECT DISTINCT ON (k.n) k.n, b.id
+FROM unnest($1::text[], $2::text[]) WITH ORDINALITY AS k(name, author, n)
+JOIN books b ON LOWER(b.name) = LOWER(k.name) AND LOWER(b.author) = LOWER(k.author) AND b.deleted_at IS NULL
+ORDER BY k.n, b.id`, pq.Array(names), pq.Array(authors))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[int]int)
+	for rows.Next() {
+		var n, id int
+		if err := rows.Scan(&n, &id); err != nil {
+			return nil, err
+		}
+
+		existing[n-1] = id
+	}
+
+	return existing, rows.Err()
+}
+
+// insertBooks inserts the books with a single multi-row statement.
+func insertBooks(ctx context.Context, tx tracedTx, books []domain.Book) ([]int, error) {
+	if len(books) == 0 {
+		return nil, nil
+	}
+
+	values := make([]string, 0, len(books))
+	args := make([]interface{}, 0, len(books)*5)
+	for _, b := range books {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5))
+		args = append(args, b.Name, b.Description, b.Author, b.IsFree, pq.Array(b.Genres))
+	}
+
+	rows, err := tx.QueryContext(ctx, "INSERT INTO books (name, description, author, is_free, genres) VALUES "+
+		strings.Join(values, ", ")+" RETURNING "+bookColumns, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	created := make([]domain.Book, 0, len(books))
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		created = append(created, b)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(created))
+	for _, b := range created {
+		if err := insertRevision(ctx, tx, domain.RevisionCreated, b); err != nil {
+			return nil, err
+		}
+
+		if err := insertOutboxEvent(ctx, tx, logger.ACTION_CREATE, logger.ENTITY_BOOK, b.ID); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, b.ID)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,143 @@
+package psql
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// booksChannel is the channel the books_notify trigger notifies.
+const booksChannel = "books_changed"
+
+type ListenerConfig struct {
+	MinReconnect time.Duration
+	MaxReconnect time.Duration
+	// PingInterval is how long the connection may stay silent before it
+	// is checked; a dead connection is only noticed when it is used
+	PingInterval time.Duration
+}
+
+// BookListener receives the book changes the books_notify trigger
+// announces, made by any instance. It holds its own connection and
+// reconnects when it is lost, then reports a missed change since
+// notifications sent meanwhile are gone.
+type BookListener struct {
+	listener *pq.Listener
+	cfg      ListenerConfig
+	changes  chan domain.BookChange
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func NewBookListener(connStr string, cfg ListenerConfig) (*BookListener, error) {
+	listener := pq.NewListener(connStr, cfg.MinReconnect, cfg.MaxReconnect, logListenerEvent)
+	if err := listener.Listen(booksChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	bl := &BookListener{
+		listener: listener,
+		cfg:      cfg,
+		changes:  make(chan domain.BookChange, 256),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go bl.run()
+
+	return bl, nil
+}
+
+// Changes delivers the changes until the listener is closed.
+func (bl *BookListener) Changes() <-chan domain.BookChange {
+	return bl.changes
+}
+
+func (bl *BookListener) Close() error {
+	bl.closeOnce.Do(func() { close(bl.done) })
+	<-bl.stopped
+
+	return bl.closeErr
+}
+
+func (bl *BookListener) run() {
+	defer close(bl.stopped)
+	defer close(bl.changes)
+	defer func() {
+		bl.closeErr = bl.listener.Close()
+		// pq closes Notify once its connection loop is done
+		for range bl.listener.Notify {
+		}
+	}()
+
+	ticker := time.NewTicker(bl.cfg.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case n, ok := <-bl.listener.Notify:
+			if !ok || !bl.send(parseBookChange(n)) {
+				return
+			}
+		case <-ticker.C:
+			go func() {
+				if err := bl.listener.Ping(); err != nil {
+					log.WithField("repository", "book listener").Warn(err)
+				}
+			}()
+		case <-bl.done:
+			return
+		}
+	}
+}
+
+func (bl *BookListener) send(change domain.BookChange) bool {
+	select {
+	case bl.changes <- change:
+		return true
+	case <-bl.done:
+		return false
+	}
+}
+
+// parseBookChange decodes a notification. pq sends nil after a
+// reconnect; that, and a payload that cannot be read, is a missed change.
+func parseBookChange(n *pq.Notification) domain.BookChange {
+	if n == nil {
+		return domain.BookChange{Missed: true}
+	}
+
+	var change domain.BookChange
+	if err := json.Unmarshal([]byte(n.Extra), &change); err != nil {
+		log.WithFields(log.Fields{
+			"repository": "book listener",
+			"payload":    n.Extra,
+		}).Error(err)
+		return domain.BookChange{Missed: true}
+	}
+
+	return change
+}
+
+func logListenerEvent(event pq.ListenerEventType, err error) {
+	entry := log.WithField("repository", "book listener")
+
+	switch event {
+	case pq.ListenerEventConnected:
+		entry.Info("Repository: listening for book changes")
+	case pq.ListenerEventDisconnected:
+		entry.WithError(err).Warn("Repository: book listener disconnected")
+	case pq.ListenerEventReconnected:
+		entry.Info("Repository: book listener reconnected")
+	case pq.ListenerEventConnectionAttemptFailed:
+		entry.WithError(err).Warn("Repository: book listener connection attempt failed")
+	}
+}
@@ -0,0 +1,134 @@
+package psql
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	"github.com/lib/pq"
+)
+
+// bookCursor points at the last row of a page: the value of the sort column
+// and the row id, which breaks ties between equal sort values. It records
+// the sort it was made for, its value means nothing in another.
+type bookCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func newBookCursor(q domain.BookQuery, last domain.Book) bookCursor {
+	return bookCursor{Sort: q.SortBy, Order: q.SortOrder, Value: sortValue(last, q.SortBy), ID: last.ID}
+}
+
+func encodeCursor(c bookCursor) string {
+	b, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (bookCursor, error) {
+	var c bookCursor
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, domain.ErrInvalidCursor
+	}
+
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, domain.ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// sortValue returns the textual value of the sort column, as postgres
+// will parse it back when it is passed as a cursor parameter.
+func sortValue(b domain.Book, field string) string {
+	switch field {
+	case "name":
+		return b.Name
+	case "description":
+		return b.Description
+	case "author":
+		return b.Author
+	case "is_free":
+		return strconv.FormatBool(b.IsFree)
+	case "published_at":
+		return b.PublishedAt.Format(time.RFC3339Nano)
+	default:
+		return strconv.Itoa(b.ID)
+	}
+}
+
+type bookFilter struct {
+	where []string
+	args  []interface{}
+}
+
+func (f *bookFilter) add(cond string, arg interface{}) {
+	f.args = append(f.args, arg)
+	f.where = append(f.where, fmt.Sprintf(cond, len(f.args)))
+}
+
+func (f *bookFilter) clause() string {
+	if len(f.where) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(f.where, " AND ")
+}
+
+func newBookFilter(q domain.BookQuery) *bookFilter {
+	// books in the trash are never listed
+	f := &bookFilter{where: []string{"deleted_at IS NULL"}}
+
+	if q.Author != "" {
+		f.add("LOWER(author) = LOWER($%d)", q.Author)
+	}
+
+	if len(q.Genres) > 0 {
+		if q.GenresMatch == domain.GenresMatchAll {
+			f.add("genres @> $%d", pq.Array(q.Genres))
+		} else {
+			f.add("genres && $%d", pq.Array(q.Genres))
+		}
+	}
+
+	if q.IsFree != nil {
+		f.add("is_free = $%d", *q.IsFree)
+	}
+
+	if q.PublishedFrom != nil {
+		f.add("published_at >= $%d", *q.PublishedFrom)
+	}
+
+	if q.PublishedTo != nil {
+		f.add("published_at <= $%d", *q.PublishedTo)
+	}
+
+	return f
+}
+
+// withCursor narrows the filter to rows after the cursor in sort order.
+// A cursor made for another sort is invalid.
+func (f *bookFilter) withCursor(q domain.BookQuery, c bookCursor) error {
+	if c.Sort != q.SortBy || c.Order != q.SortOrder {
+		return domain.ErrInvalidCursor
+	}
+
+	op := ">"
+	if q.SortOrder == domain.SortDesc {
+		op = "<"
+	}
+
+	f.args = append(f.args, c.Value, c.ID)
+	f.where = append(f.where, fmt.Sprintf("(%s, id) %s ($%d, $%d)", q.SortBy, op, len(f.args)-1, len(f.args)))
+
+	return nil
+}
@@ -4,55 +4,162 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
 
 	"github.com/jackietana/crud-app/internal/domain"
+	logger "github.com/jackietana/grpc-logger/pkg/domain"
 	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 )
 
+const bookColumns = "id, name, description, author, is_free, genres, published_at, version, deleted_at"
+
+// Matches are delimited with control characters, stripped from the text
+// first, so the text can be escaped before they become <mark> tags.
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// searchBooksQuery takes the search query, limit, offset, the highlight
+// delimiters and the ts_headline options for the name and author, then
+// for the description snippet.
+const searchBooksQuery = `
+SELECT id, name, description, author, is_free, genres, published_at, version,
+	ts_rank_cd(search_vector, query) AS rank,
+	ts_headline('english', translate(name, $4, ''), query, $5),
+	ts_headline('english', translate(author, $4, ''), query, $5),
+	ts_headline('english', translate(description, $4, ''), query, $6)
+FROM books, websearch_to_tsquery('english', $1) query
+WHERE search_vector @@ query AND deleted_at IS NULL
+ORDER BY rank DESC, id
+LIMIT $2 OFFSET $3`
+
 type BookRepository struct {
-	db *sql.DB
+	db tracedDB
 }
 
 func NewBookRepo(db *sql.DB) *BookRepository {
-	return &BookRepository{db}
+	return &BookRepository{tracedDB{db}}
 }
 
-func (br *BookRepository) GetBooks(ctx context.Context) ([]domain.Book, error) {
-	rows, err := br.db.QueryContext(ctx, "SELECT * FROM books")
+func (br *BookRepository) GetBooks(ctx context.Context, q domain.BookQuery) (domain.BookPage, error) {
+	page := domain.BookPage{Books: make([]domain.Book, 0), Limit: q.Limit, Offset: q.Offset}
+
+	f := newBookFilter(q)
+	if err := br.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM books"+f.clause(), f.args...).
+		Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return page, err
+		}
+
+		if err := f.withCursor(q, c); err != nil {
+			return page, err
+		}
+		page.Offset = 0
+	}
+
+	strQuery := fmt.Sprintf("SELECT %s FROM books%s ORDER BY %s %s, id %s LIMIT %d",
+		bookColumns, f.clause(), q.SortBy, q.SortOrder, q.SortOrder, q.Limit+1)
+	if q.Cursor == "" && q.Offset > 0 {
+		strQuery += fmt.Sprintf(" OFFSET %d", q.Offset)
+	}
+
+	rows, err := br.db.QueryContext(ctx, strQuery, f.args...)
 	if err != nil {
-		return nil, err
+		return page, err
 	}
 	defer rows.Close()
 
-	books := make([]domain.Book, 0)
-
 	for rows.Next() {
-		b := domain.Book{}
-		if err := rows.Scan(&b.ID, &b.Name, &b.Description, &b.Author, &b.IsFree, pq.Array(&b.Genres),
-			&b.PublishedAt); err != nil {
-			return nil, err
+		b, err := scanBook(rows)
+		if err != nil {
+			return page, err
 		}
 
-		books = append(books, b)
+		page.Books = append(page.Books, b)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return page, err
+	}
+
+	// one extra row was requested to find out whether there is a next page
+	if len(page.Books) > q.Limit {
+		page.Books = page.Books[:q.Limit]
+
+		last := page.Books[len(page.Books)-1]
+		page.NextCursor = encodeCursor(newBookCursor(q, last))
 	}
 
 	log.Info("Repository: GetBooks")
 
-	return books, nil
+	return page, nil
+}
+
+func (br *BookRepository) SearchBooks(ctx context.Context, q domain.BookSearchQuery) (domain.BookSearchPage, error) {
+	page := domain.BookSearchPage{Results: make([]domain.BookSearchResult, 0), Limit: q.Limit, Offset: q.Offset}
+
+	err := br.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM books WHERE search_vector @@ websearch_to_tsquery('english', $1) AND deleted_at IS NULL",
+		q.Query).
+		Scan(&page.Total)
+	if err != nil {
+		return page, err
+	}
+
+	selectors := fmt.Sprintf("StartSel=%s, StopSel=%s", highlightStart, highlightStop)
+	rows, err := br.db.QueryContext(ctx, searchBooksQuery, q.Query, q.Limit, q.Offset,
+		highlightStart+highlightStop, selectors+", HighlightAll=true", selectors+", MinWords=15, MaxWords=35")
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := domain.BookSearchResult{}
+		if err := rows.Scan(&r.ID, &r.Name, &r.Description, &r.Author, &r.IsFree, pq.Array(&r.Genres),
+			&r.PublishedAt, &r.Version, &r.Rank, &r.NameHighlight, &r.AuthorHighlight, &r.Snippet); err != nil {
+			return page, err
+		}
+
+		r.NameHighlight = highlight(r.NameHighlight)
+		r.AuthorHighlight = highlight(r.AuthorHighlight)
+		r.Snippet = highlight(r.Snippet)
+
+		page.Results = append(page.Results, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return page, err
+	}
+
+	log.WithField("query", q.Query).Info("Repository: SearchBooks")
+
+	return page, nil
+}
+
+var highlightTags = strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>")
+
+// highlight escapes a ts_headline result for HTML and wraps the matches it
+// delimited in <mark> tags.
+func highlight(headline string) string {
+	return highlightTags.Replace(html.EscapeString(headline))
 }
 
 func (br *BookRepository) GetBookById(ctx context.Context, id int) (domain.Book, error) {
-	var b domain.Book
-	err := br.db.QueryRowContext(ctx, "SELECT * FROM books WHERE id=$1", id).
-		Scan(&b.ID, &b.Name, &b.Description, &b.Author, &b.IsFree, pq.Array(&b.Genres), &b.PublishedAt)
+	b, err := scanBook(br.db.QueryRowContext(ctx, "SELECT "+bookColumns+" FROM books WHERE id=$1 AND deleted_at IS NULL", id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return b, errors.New("book not found")
+			return b, domain.ErrBookNotFound
 		}
 
 		return b, err
@@ -63,51 +170,334 @@ func (br *BookRepository) GetBookById(ctx context.Context, id int) (domain.Book,
 	return b, err
 }
 
-func (br *BookRepository) CreateBook(ctx context.Context, b domain.Book) error {
-	strExec := "INSERT INTO books (name, description, author, is_free, genres) VALUES ($1, $2, $3, $4, $5)"
-	_, err := br.db.ExecContext(ctx, strExec, b.Name, b.Description, b.Author, b.IsFree, pq.Array(b.Genres))
+func (br *BookRepository) CreateBook(ctx context.Context, b domain.Book) (domain.Book, error) {
+	strExec := "INSERT INTO books (name, description, author, is_free, genres) VALUES ($1, $2, $3, $4, $5) RETURNING id, published_at, version"
 
-	log.Info("Repository: CreateBook")
+	err := br.db.withTx(ctx, func(tx tracedTx) error {
+		if err := tx.QueryRowContext(ctx, strExec, b.Name, b.Description, b.Author, b.IsFree, pq.Array(b.Genres)).
+			Scan(&b.ID, &b.PublishedAt, &b.Version); err != nil {
+			return err
+		}
+
+		if err := insertRevision(ctx, tx, domain.RevisionCreated, b); err != nil {
+			return err
+		}
+
+		return insertOutboxEvent(ctx, tx, logger.ACTION_CREATE, logger.ENTITY_BOOK, b.ID)
+	})
+
+	log.WithField("id", b.ID).Info("Repository: CreateBook")
+
+	return b, err
+}
+
+// DeleteBook moves the book to the trash if it is at the given version,
+// or at any version when version is 0.
+func (br *BookRepository) DeleteBook(ctx context.Context, id, version int) error {
+	strExec, args := withVersion("UPDATE books SET deleted_at=now(), version=version+1 WHERE id=$1 AND deleted_at IS NULL",
+		[]interface{}{id}, version)
+
+	err := br.db.withTx(ctx, func(tx tracedTx) error {
+		b, err := scanBook(tx.QueryRowContext(ctx, strExec+" RETURNING "+bookColumns, args...))
+		if errors.Is(err, sql.ErrNoRows) {
+			return bookNotChanged(ctx, tx, id, false)
+		} else if err != nil {
+			return err
+		}
+
+		if err := insertRevision(ctx, tx, domain.RevisionDeleted, b); err != nil {
+			return err
+		}
+
+		return insertOutboxEvent(ctx, tx, logger.ACTION_DELETE, logger.ENTITY_BOOK, id)
+	})
+
+	log.WithField("id", id).Info("Repository: DeleteBook")
 
 	return err
 }
 
-func (br *BookRepository) DeleteBook(ctx context.Context, id int) error {
-	exists, err := br.bookExistsByID(ctx, id)
+// PurgeBook deletes the book for good, whether it is in the trash or
+// not, if it is at the given version or at any version when version is 0.
+func (br *BookRepository) PurgeBook(ctx context.Context, id, version int) error {
+	strExec, args := withVersion("DELETE FROM books WHERE id=$1", []interface{}{id}, version)
+
+	err := br.db.withTx(ctx, func(tx tracedTx) error {
+		b, err := scanBook(tx.QueryRowContext(ctx, strExec+" RETURNING "+bookColumns, args...))
+		if errors.Is(err, sql.ErrNoRows) {
+			return bookNotChanged(ctx, tx, id, true)
+		} else if err != nil {
+			return err
+		}
+
+		return purged(ctx, tx, b)
+	})
+
+	log.WithField("id", id).Info("Repository: PurgeBook")
+
+	return err
+}
+
+// PurgeDeleted deletes the books moved to the trash before the given
+// time and returns their ids.
+func (br *BookRepository) PurgeDeleted(ctx context.Context, before time.Time) ([]int, error) {
+	var ids []int
+
+	err := br.db.withTx(ctx, func(tx tracedTx) error {
+		rows, err := tx.QueryContext(ctx, "DELETE FROM books WHERE deleted_at < $1 RETURNING "+bookColumns, before)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var books []domain.Book
+		for rows.Next() {
+			b, err := scanBook(rows)
+			if err != nil {
+				return err
+			}
+
+			books = append(books, b)
+		}
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, b := range books {
+			if err := purged(ctx, tx, b); err != nil {
+				return err
+			}
+
+			ids = append(ids, b.ID)
+		}
+
+		return nil
+	})
 	if err != nil {
+		return nil, err
+	}
+
+	log.WithField("count", len(ids)).Info("Repository: PurgeDeleted")
+
+	return ids, nil
+}
+
+// purged records the purge of a book as one more revision.
+func purged(ctx context.Context, tx tracedTx, b domain.Book) error {
+	b.Version++
+	if err := insertRevision(ctx, tx, domain.RevisionPurged, b); err != nil {
 		return err
-	} else if !exists {
-		return errors.New("book not found")
 	}
 
-	_, err = br.db.ExecContext(ctx, "DELETE FROM books WHERE id=$1", id)
+	return insertOutboxEvent(ctx, tx, logger.ACTION_DELETE, logger.ENTITY_BOOK, b.ID)
+}
 
-	log.WithField("id", id).Info("Repository: DeleteBook")
+// RestoreBook takes the book out of the trash and returns it with its
+// new version.
+func (br *BookRepository) RestoreBook(ctx context.Context, id int) (domain.Book, error) {
+	var b domain.Book
 
-	return err
+	err := br.db.withTx(ctx, func(tx tracedTx) error {
+		var err error
+
+		b, err = scanBook(tx.QueryRowContext(ctx, "UPDATE books SET deleted_at=NULL, version=version+1 "+
+			"WHERE id=$1 AND deleted_at IS NOT NULL RETURNING "+bookColumns, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			// a book found outside the trash has nothing to restore
+			if err = bookNotChanged(ctx, tx, id, false); errors.Is(err, domain.ErrVersionMismatch) {
+				return domain.ErrBookNotInTrash
+			}
+
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		if err := insertRevision(ctx, tx, domain.RevisionRestored, b); err != nil {
+			return err
+		}
+
+		return insertOutboxEvent(ctx, tx, logger.ACTION_UPDATE, logger.ENTITY_BOOK, id)
+	})
+
+	log.WithField("id", id).Info("Repository: RestoreBook")
+
+	return b, err
 }
 
-func (br *BookRepository) UpdateBook(ctx context.Context, id int, b domain.Book) error {
-	exists, err := br.bookExistsByID(ctx, id)
+// GetTrash lists the books in the trash, most recently deleted first.
+func (br *BookRepository) GetTrash(ctx context.Context, limit, offset int) (domain.BookPage, error) {
+	page := domain.BookPage{Books: make([]domain.Book, 0), Limit: limit, Offset: offset}
+
+	if err := br.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM books WHERE deleted_at IS NOT NULL").
+		Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	rows, err := br.db.QueryContext(ctx, "SELECT "+bookColumns+" FROM books WHERE deleted_at IS NOT NULL "+
+		"ORDER BY deleted_at DESC, id DESC LIMIT $1 OFFSET $2", limit, offset)
 	if err != nil {
-		return err
-	} else if !exists {
-		return errors.New("book not found")
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return page, err
+		}
+
+		page.Books = append(page.Books, b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return page, err
 	}
 
-	strExec := "UPDATE books SET name=$1, description=$2, author=$3, is_free=$4, genres=$5 WHERE id=$6"
-	_, err = br.db.ExecContext(ctx, strExec, b.Name, b.Description, b.Author, b.IsFree, pq.Array(b.Genres), id)
+	log.WithField("count", len(page.Books)).Info("Repository: GetTrash")
+
+	return page, nil
+}
+
+// UpdateBook overwrites the book if it is at the given version, or at
+// any version when version is 0, and returns it with its new version.
+func (br *BookRepository) UpdateBook(ctx context.Context, id int, b domain.Book, version int) (domain.Book, error) {
+	err := br.db.withTx(ctx, func(tx tracedTx) error {
+		var err error
+
+		b, err = updateBook(ctx, tx, id, b, version, domain.RevisionUpdated)
+
+		return err
+	})
 
 	log.WithField("id", id).Info("Repository: UpdateBook")
 
-	return err
+	return b, err
+}
+
+func updateBook(ctx context.Context, tx tracedTx, id int, b domain.Book, version int,
+	action string) (domain.Book, error) {
+	strExec, args := withVersion("UPDATE books SET name=$1, description=$2, author=$3, is_free=$4, genres=$5, "+
+		"version=version+1 WHERE id=$6 AND deleted_at IS NULL", []interface{}{b.Name, b.Description, b.Author, b.IsFree,
+		pq.Array(b.Genres), id}, version)
+
+	b, err := scanBook(tx.QueryRowContext(ctx, strExec+" RETURNING "+bookColumns, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return b, bookNotChanged(ctx, tx, id, false)
+	} else if err != nil {
+		return b, err
+	}
+
+	if err := insertRevision(ctx, tx, action, b); err != nil {
+		return b, err
+	}
+
+	return b, insertOutboxEvent(ctx, tx, logger.ACTION_UPDATE, logger.ENTITY_BOOK, id)
 }
 
-func (br *BookRepository) bookExistsByID(ctx context.Context, id int) (bool, error) {
+// PatchBook updates only the columns set in the patch, if the book is at
+// the given version or at any version when version is 0. It returns the
+// patched book with its new version.
+func (br *BookRepository) PatchBook(ctx context.Context, id int, p domain.BookPatch, version int) (domain.Book, error) {
+	var (
+		sets []string
+		args []interface{}
+	)
+
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s=$%d", column, len(args)))
+	}
+
+	if p.Name != nil {
+		set("name", *p.Name)
+	}
+	if p.Description != nil {
+		set("description", *p.Description)
+	}
+	if p.Author != nil {
+		set("author", *p.Author)
+	}
+	if p.IsFree != nil {
+		set("is_free", *p.IsFree)
+	}
+	if p.GenresSet {
+		set("genres", pq.Array(p.Genres))
+	}
+
+	if len(sets) == 0 {
+		return br.GetBookById(ctx, id)
+	}
+
+	args = append(args, id)
+	strExec, args := withVersion(fmt.Sprintf("UPDATE books SET %s, version=version+1 WHERE id=$%d AND deleted_at IS NULL",
+		strings.Join(sets, ", "), len(args)), args, version)
+
+	var b domain.Book
+	err := br.db.withTx(ctx, func(tx tracedTx) error {
+		var err error
+
+		b, err = scanBook(tx.QueryRowContext(ctx, strExec+" RETURNING "+bookColumns, args...))
+		if errors.Is(err, sql.ErrNoRows) {
+			return bookNotChanged(ctx, tx, id, false)
+		} else if err != nil {
+			return err
+		}
+
+		if err := insertRevision(ctx, tx, domain.RevisionUpdated, b); err != nil {
+			return err
+		}
+
+		return insertOutboxEvent(ctx, tx, logger.ACTION_UPDATE, logger.ENTITY_BOOK, id)
+	})
+
+	log.WithFields(log.Fields{"id": id, "columns": len(sets)}).Info("Repository: PatchBook")
+
+	return b, err
+}
+
+// withVersion adds the version condition to a statement on a single book.
+func withVersion(strExec string, args []interface{}, version int) (string, []interface{}) {
+	if version == 0 {
+		return strExec, args
+	}
+
+	args = append(args, version)
+
+	return fmt.Sprintf("%s AND version=$%d", strExec, len(args)), args
+}
+
+// bookNotChanged tells why a statement on a single book matched no rows:
+// the book is missing or it is at another version. Books in the trash
+// count as missing unless withTrash is set.
+func bookNotChanged(ctx context.Context, tx tracedTx, id int, withTrash bool) error {
+	strQuery := "SELECT EXISTS(SELECT 1 FROM books WHERE id=$1 AND deleted_at IS NULL)"
+	if withTrash {
+		strQuery = "SELECT EXISTS(SELECT 1 FROM books WHERE id=$1)"
+	}
+
 	var exists bool
-	err := br.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM books WHERE id=$1)", id).Scan(&exists)
-	if err != nil {
-		return false, err
+	if err := tx.QueryRowContext(ctx, strQuery, id).Scan(&exists); err != nil {
+		return err
 	}
-	return exists, nil
+
+	if exists {
+		return domain.ErrVersionMismatch
+	}
+
+	return domain.ErrBookNotFound
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanBook reads a row selected with bookColumns.
+func scanBook(row rowScanner) (domain.Book, error) {
+	var b domain.Book
+	err := row.Scan(&b.ID, &b.Name, &b.Description, &b.Author, &b.IsFree, pq.Array(&b.Genres), &b.PublishedAt,
+		&b.Version, &b.DeletedAt)
+
+	return b, err
 }
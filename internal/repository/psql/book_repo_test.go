@@ -0,0 +1,35 @@
+package psql
+
+import "testing"
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name     string
+		headline string
+		want     string
+	}{
+		{
+			name:     "matches are marked",
+			headline: "The \x02Go\x03 Programming \x02Language\x03",
+			want:     "The <mark>Go</mark> Programming <mark>Language</mark>",
+		},
+		{
+			name:     "markup in the text is escaped",
+			headline: "<script>alert(1)</script> \x02Go\x03 & <mark>\"C\"</mark>",
+			want:     "&lt;script&gt;alert(1)&lt;/script&gt; <mark>Go</mark> &amp; &lt;mark&gt;&#34;C&#34;&lt;/mark&gt;",
+		},
+		{
+			name:     "no match",
+			headline: "Plain text",
+			want:     "Plain text",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlight(tt.headline); got != tt.want {
+				t.Errorf("highlight(%q) = %q, want %q", tt.headline, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+const revisionColumns = "book_id, revision, action, name, description, author, is_free, genres, published_at, " +
+	"deleted_at, actor_id, created_at"
+
+// insertRevision snapshots the book as written by the same transaction.
+func insertRevision(ctx context.Context, tx tracedTx, action string, b domain.Book) error {
+	var actorId sql.NullInt64
+	if userId, ok := domain.UserIDFromContext(ctx); ok {
+		actorId = sql.NullInt64{Int64: int64(userId), Valid: true}
+	}
+
+	_, err := tx.ExecContext(ctx, "INSERT INTO book_revisions (book_id, revision, action, name, description, author, "+
+		"is_free, genres, published_at, deleted_at, actor_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		b.ID, b.Version, action, b.Name, b.Description, b.Author, b.IsFree, pq.Array(b.Genres), b.PublishedAt,
+		b.DeletedAt, actorId)
+
+	return err
+}
+
+// GetRevisions lists the revisions of a book, newest first. Revisions
+// outlive the book, so a purged book still has its history.
+func (br *BookRepository) GetRevisions(ctx context.Context, id, limit, offset int) (domain.BookRevisionPage, error) {
+	page := domain.BookRevisionPage{Revisions: make([]domain.BookRevision, 0), Limit: limit, Offset: offset}
+
+	if err := br.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM book_revisions WHERE book_id=$1", id).
+		Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	if page.Total == 0 {
+		return page, domain.ErrBookNotFound
+	}
+
+	rows, err := br.db.QueryContext(ctx, "SELECT "+revisionColumns+" FROM book_revisions WHERE book_id=$1 "+
+		"ORDER BY revision DESC LIMIT $2 OFFSET $3", id, limit, offset)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanRevision(rows)
+		if err != nil {
+			return page, err
+		}
+
+		page.Revisions = append(page.Revisions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return page, err
+	}
+
+	log.WithFields(log.Fields{"id": id, "count": len(page.Revisions)}).Info("Repository: GetRevisions")
+
+	return page, nil
+}
+
+func (br *BookRepository) GetRevision(ctx context.Context, id, rev int) (domain.BookRevision, error) {
+	r, err := getRevision(ctx, br.db, id, rev)
+
+	log.WithFields(log.Fields{"id": id, "revision": rev}).Info("Repository: GetRevision")
+
+	return r, err
+}
+
+// RevertBook overwrites the book with the fields of one of its revisions,
+// if it is at the given version or at any version when version is 0.
+// The revert is a new revision; books in the trash must be restored first.
+func (br *BookRepository) RevertBook(ctx context.Context, id, rev, version int) (domain.Book, error) {
+	var b domain.Book
+
+	err := br.db.withTx(ctx, func(tx tracedTx) error {
+		r, err := getRevision(ctx, tx, id, rev)
+		if err != nil {
+			return err
+		}
+
+		b, err = updateBook(ctx, tx, id, r.Book, version, domain.RevisionReverted)
+
+		return err
+	})
+
+	log.WithFields(log.Fields{"id": id, "revision": rev}).Info("Repository: RevertBook")
+
+	return b, err
+}
+
+// rowQuerier is a tracedDB or a tracedTx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func getRevision(ctx context.Context, q rowQuerier, id, rev int) (domain.BookRevision, error) {
+	r, err := scanRevision(q.QueryRowContext(ctx, "SELECT "+revisionColumns+
+		" FROM book_revisions WHERE book_id=$1 AND revision=$2", id, rev))
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, domain.ErrRevisionNotFound
+	}
+
+	return r, err
+}
+
+// scanRevision reads a row selected with revisionColumns.
+func scanRevision(row rowScanner) (domain.BookRevision, error) {
+	var (
+		r       domain.BookRevision
+		actorId sql.NullInt64
+	)
+
+	err := row.Scan(&r.BookID, &r.Revision, &r.Action, &r.Book.Name, &r.Book.Description, &r.Book.Author,
+		&r.Book.IsFree, pq.Array(&r.Book.Genres), &r.Book.PublishedAt, &r.Book.DeletedAt, &actorId, &r.CreatedAt)
+	if err != nil {
+		return r, err
+	}
+
+	r.Book.ID, r.Book.Version = r.BookID, r.Revision
+	if actorId.Valid {
+		id := int(actorId.Int64)
+		r.ActorID = &id
+	}
+
+	return r, nil
+}
@@ -0,0 +1,42 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DenylistRepository stores revoked access token identifiers until the
+// tokens would have expired anyway.
+type DenylistRepository struct {
+	db *sql.DB
+}
+
+func NewDenylistRepo(db *sql.DB) *DenylistRepository {
+	return &DenylistRepository{db}
+}
+
+func (dr *DenylistRepository) Add(ctx context.Context, key string, expiresAt time.Time) error {
+	strExec := `INSERT INTO token_denylist (key, expires_at) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET expires_at=GREATEST(token_denylist.expires_at, EXCLUDED.expires_at)`
+	if _, err := dr.db.ExecContext(ctx, strExec, key, expiresAt.UTC()); err != nil {
+		return err
+	}
+
+	// expired entries are useless, drop them while we are here
+	if _, err := dr.db.ExecContext(ctx, "DELETE FROM token_denylist WHERE expires_at < $1", time.Now().UTC()); err != nil {
+		log.WithField("repository", "Denylist.Add").Error(err)
+	}
+
+	return nil
+}
+
+func (dr *DenylistRepository) Contains(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := dr.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM token_denylist WHERE key=$1 AND expires_at > $2)",
+		key, time.Now().UTC()).Scan(&exists)
+
+	return exists, err
+}
@@ -0,0 +1,159 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+const outboxColumns = "id, entity, action, entity_id, actor_id, created_at, attempts, last_error, locked_until"
+
+// claimOutboxQuery leases the oldest pending events to one relay. Rows
+// leased by another relay are skipped until their lease runs out, so a
+// relay that died mid-batch hands its events over to the others.
+const claimOutboxQuery = `
+UPDATE outbox SET locked_until = now() + make_interval(secs => $2), attempts = attempts + 1
+WHERE id IN (
+	SELECT id FROM outbox
+	WHERE sent_at IS NULL AND (locked_until IS NULL OR locked_until < now())
+	ORDER BY id
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING ` + outboxColumns
+
+// insertOutboxEvent records an audit event in the transaction of the
+// change it describes. The actor is the user in the context, if any.
+func insertOutboxEvent(ctx context.Context, tx tracedTx, action, entity string, entityId int) error {
+	var actorId sql.NullInt64
+	if userId, ok := domain.UserIDFromContext(ctx); ok {
+		actorId = sql.NullInt64{Int64: int64(userId), Valid: true}
+	}
+
+	_, err := tx.ExecContext(ctx, "INSERT INTO outbox (entity, action, entity_id, actor_id) VALUES ($1, $2, $3, $4)",
+		entity, action, entityId, actorId)
+
+	return err
+}
+
+type OutboxRepository struct {
+	db tracedDB
+}
+
+func NewOutboxRepo(db *sql.DB) *OutboxRepository {
+	return &OutboxRepository{tracedDB{db}}
+}
+
+func (or *OutboxRepository) Claim(ctx context.Context, limit int, lease time.Duration) ([]domain.OutboxEvent, error) {
+	rows, err := or.db.QueryContext(ctx, claimOutboxQuery, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := scanOutboxEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// RETURNING does not keep the subquery order
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+
+	return events, nil
+}
+
+func (or *OutboxRepository) MarkSent(ctx context.Context, id int64) error {
+	_, err := or.db.ExecContext(ctx, "UPDATE outbox SET sent_at=now(), locked_until=NULL, last_error=NULL WHERE id=$1", id)
+
+	return err
+}
+
+// Release hands claimed events back before their lease runs out, without
+// counting the claim as an attempt.
+func (or *OutboxRepository) Release(ctx context.Context, ids []int64) error {
+	_, err := or.db.ExecContext(ctx,
+		"UPDATE outbox SET locked_until=NULL, attempts=attempts-1 WHERE id = ANY($1) AND sent_at IS NULL",
+		pq.Array(ids))
+
+	return err
+}
+
+// MarkFailed keeps the event pending and holds it back for retryAfter.
+func (or *OutboxRepository) MarkFailed(ctx context.Context, id int64, reason string, retryAfter time.Duration) error {
+	_, err := or.db.ExecContext(ctx,
+		"UPDATE outbox SET last_error=$1, locked_until=now() + make_interval(secs => $2) WHERE id=$3",
+		reason, retryAfter.Seconds(), id)
+
+	return err
+}
+
+// GetStatus counts pending events and lists those pending for longer
+// than stuckAfter, oldest first.
+func (or *OutboxRepository) GetStatus(ctx context.Context, stuckAfter time.Duration, limit int) (domain.OutboxStatus, error) {
+	status := domain.OutboxStatus{Stuck: make([]domain.OutboxEvent, 0)}
+
+	if err := or.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM outbox WHERE sent_at IS NULL").
+		Scan(&status.Pending); err != nil {
+		return status, err
+	}
+
+	rows, err := or.db.QueryContext(ctx, "SELECT "+outboxColumns+` FROM outbox
+		WHERE sent_at IS NULL AND created_at < now() - make_interval(secs => $1)
+		ORDER BY id LIMIT $2`, stuckAfter.Seconds(), limit)
+	if err != nil {
+		return status, err
+	}
+
+	stuck, err := scanOutboxEvents(rows)
+	if err != nil {
+		return status, err
+	}
+
+	status.Stuck = append(status.Stuck, stuck...)
+
+	log.WithField("pending", status.Pending).Info("Repository: GetOutboxStatus")
+
+	return status, nil
+}
+
+// DeleteSent removes events sent before the given time.
+func (or *OutboxRepository) DeleteSent(ctx context.Context, before time.Time) (int64, error) {
+	res, err := or.db.ExecContext(ctx, "DELETE FROM outbox WHERE sent_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func scanOutboxEvents(rows *sql.Rows) ([]domain.OutboxEvent, error) {
+	defer rows.Close()
+
+	var events []domain.OutboxEvent
+	for rows.Next() {
+		var (
+			e         domain.OutboxEvent
+			actorId   sql.NullInt64
+			lastError sql.NullString
+		)
+
+		if err := rows.Scan(&e.ID, &e.Entity, &e.Action, &e.EntityID, &actorId, &e.CreatedAt,
+			&e.Attempts, &lastError, &e.LockedUntil); err != nil {
+			return nil, err
+		}
+
+		if actorId.Valid {
+			id := int(actorId.Int64)
+			e.ActorID = &id
+		}
+		e.LastError = lastError.String
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
@@ -3,8 +3,10 @@ package psql
 import (
 	"context"
 	"database/sql"
+	"errors"
 
 	"github.com/jackietana/crud-app/internal/domain"
+	log "github.com/sirupsen/logrus"
 )
 
 type TokenRepository struct {
@@ -15,22 +17,143 @@ func NewTokenRepo(db *sql.DB) *TokenRepository {
 	return &TokenRepository{db}
 }
 
+func (tr *TokenRepository) CreateSession(ctx context.Context, s domain.Session) (int, error) {
+	strExec := "INSERT INTO sessions (user_id, user_agent, ip) VALUES ($1, $2, $3) RETURNING id"
+
+	var id int
+	err := tr.db.QueryRowContext(ctx, strExec, s.UserID, s.UserAgent, s.IP).Scan(&id)
+
+	log.WithField("user_id", s.UserID).Info("Repository: CreateSession")
+
+	return id, err
+}
+
+func (tr *TokenRepository) GetSession(ctx context.Context, id int) (domain.Session, error) {
+	strQuery := "SELECT id, user_id, user_agent, ip, created_at, last_used_at, revoked_at FROM sessions WHERE id=$1"
+
+	var s domain.Session
+	err := tr.db.QueryRowContext(ctx, strQuery, id).
+		Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt, &s.RevokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, domain.ErrSessionNotFound
+	}
+
+	return s, err
+}
+
+// GetSessions returns the sessions of a user that are not revoked and
+// still hold an unused, unexpired refresh token.
+func (tr *TokenRepository) GetSessions(ctx context.Context, userId int) ([]domain.Session, error) {
+	strQuery := `SELECT s.id, s.user_id, s.user_agent, s.ip, s.created_at, s.last_used_at, s.revoked_at
+		FROM sessions s
+		WHERE s.user_id=$1 AND s.revoked_at IS NULL AND EXISTS (
+			SELECT 1 FROM refresh_tokens t
+			WHERE t.session_id=s.id AND t.used_at IS NULL AND t.expires_at > NOW())
+		ORDER BY s.last_used_at DESC`
+
+	rows, err := tr.db.QueryContext(ctx, strQuery, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]domain.Session, 0)
+
+	for rows.Next() {
+		var s domain.Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt,
+			&s.RevokedAt); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (tr *TokenRepository) TouchSession(ctx context.Context, id int, meta domain.SessionMeta) error {
+	strExec := "UPDATE sessions SET user_agent=$1, ip=$2, last_used_at=NOW() WHERE id=$3"
+	_, err := tr.db.ExecContext(ctx, strExec, meta.UserAgent, meta.IP, id)
+
+	return err
+}
+
+// RevokeSession revokes a session of the given user, which invalidates
+// every refresh token of the session.
+func (tr *TokenRepository) RevokeSession(ctx context.Context, userId, id int) error {
+	strExec := "UPDATE sessions SET revoked_at=NOW() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL"
+
+	res, err := tr.db.ExecContext(ctx, strExec, id, userId)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return domain.ErrSessionNotFound
+	}
+
+	log.WithField("id", id).Info("Repository: RevokeSession")
+
+	return nil
+}
+
+// RevokeSessions revokes every active session of a user and returns their ids.
+func (tr *TokenRepository) RevokeSessions(ctx context.Context, userId int) ([]int, error) {
+	rows, err := tr.db.QueryContext(ctx,
+		"UPDATE sessions SET revoked_at=NOW() WHERE user_id=$1 AND revoked_at IS NULL RETURNING id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0)
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	log.WithField("user_id", userId).Info("Repository: RevokeSessions")
+
+	return ids, rows.Err()
+}
+
 func (tr *TokenRepository) Create(ctx context.Context, t domain.RefreshToken) error {
-	strExec := "INSERT INTO refresh_tokens (user_id, token, expires_at) values ($1, $2, $3)"
-	_, err := tr.db.ExecContext(ctx, strExec, t.UserID, t.Token, t.ExpiresAt)
+	strExec := "INSERT INTO refresh_tokens (session_id, user_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)"
+	_, err := tr.db.ExecContext(ctx, strExec, t.SessionID, t.UserID, t.TokenHash, t.ExpiresAt)
 
 	return err
 }
 
-func (tr *TokenRepository) Get(ctx context.Context, token string) (domain.RefreshToken, error) {
-	strExec := "SELECT id, user_id, token, expires_at FROM refresh_tokens WHERE token=$1"
+func (tr *TokenRepository) Get(ctx context.Context, tokenHash string) (domain.RefreshToken, error) {
+	strQuery := "SELECT id, session_id, user_id, token_hash, expires_at, used_at FROM refresh_tokens WHERE token_hash=$1"
+
 	var t domain.RefreshToken
-	err := tr.db.QueryRowContext(ctx, strExec, token).Scan(&t.ID, &t.UserID, &t.Token, &t.ExpiresAt)
+	err := tr.db.QueryRowContext(ctx, strQuery, tokenHash).
+		Scan(&t.ID, &t.SessionID, &t.UserID, &t.TokenHash, &t.ExpiresAt, &t.UsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, domain.ErrInvalidRefreshToken
+	}
+
+	return t, err
+}
+
+// MarkUsed marks a token as rotated. It reports false if the token had
+// already been used, so two concurrent refreshes cannot both succeed.
+func (tr *TokenRepository) MarkUsed(ctx context.Context, id int) (bool, error) {
+	res, err := tr.db.ExecContext(ctx, "UPDATE refresh_tokens SET used_at=NOW() WHERE id=$1 AND used_at IS NULL", id)
 	if err != nil {
-		return t, err
+		return false, err
 	}
 
-	_, err = tr.db.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE user_id=$1", t.UserID)
+	n, err := res.RowsAffected()
 
-	return t, err
+	return n == 1, err
 }
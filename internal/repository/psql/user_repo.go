@@ -6,30 +6,39 @@ import (
 	"errors"
 
 	"github.com/jackietana/crud-app/internal/domain"
+	logger "github.com/jackietana/grpc-logger/pkg/domain"
 	log "github.com/sirupsen/logrus"
 )
 
 type UserRepository struct {
-	db *sql.DB
+	db tracedDB
 }
 
 func NewUserRepo(db *sql.DB) *UserRepository {
-	return &UserRepository{db}
+	return &UserRepository{tracedDB{db}}
 }
 
 func (ur *UserRepository) CreateUser(ctx context.Context, user domain.User) error {
-	strExec := "INSERT INTO users (name, email, password) VALUES ($1, $2, $3)"
-	_, err := ur.db.ExecContext(ctx, strExec, user.Name, user.Email, user.Password)
+	strExec := "INSERT INTO users (name, email, password) VALUES ($1, $2, $3) RETURNING id"
+
+	err := ur.db.withTx(ctx, func(tx tracedTx) error {
+		var id int
+		if err := tx.QueryRowContext(ctx, strExec, user.Name, user.Email, user.Password).Scan(&id); err != nil {
+			return err
+		}
+
+		return insertOutboxEvent(ctx, tx, logger.ACTION_REGISTER, logger.ENTITY_USER, id)
+	})
 
 	log.Info("Repository: CreateUser")
 
 	return err
 }
 
-func (ur *UserRepository) GetByCredentials(ctx context.Context, email, password string) (domain.User, error) {
+func (ur *UserRepository) GetByEmail(ctx context.Context, email string) (domain.User, error) {
 	var u domain.User
-	err := ur.db.QueryRowContext(ctx, "SELECT id, name, email, registered_at FROM users WHERE email=$1 AND password=$2", email, password).
-		Scan(&u.ID, &u.Name, &u.Email, &u.RegisteredAt)
+	err := ur.db.QueryRowContext(ctx, "SELECT id, name, email, password, role, registered_at FROM users WHERE email=$1", email).
+		Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.Role, &u.RegisteredAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return u, domain.ErrUserNotFound
@@ -38,7 +47,49 @@ func (ur *UserRepository) GetByCredentials(ctx context.Context, email, password
 		return u, err
 	}
 
-	log.WithField("id", u.ID).Info("Repository: GetByCredentials")
+	log.WithField("id", u.ID).Info("Repository: GetByEmail")
 
 	return u, err
 }
+
+func (ur *UserRepository) GetByID(ctx context.Context, id int) (domain.User, error) {
+	var u domain.User
+	err := ur.db.QueryRowContext(ctx, "SELECT id, name, email, role, registered_at FROM users WHERE id=$1", id).
+		Scan(&u.ID, &u.Name, &u.Email, &u.Role, &u.RegisteredAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return u, domain.ErrUserNotFound
+		}
+
+		return u, err
+	}
+
+	log.WithField("id", u.ID).Info("Repository: GetByID")
+
+	return u, err
+}
+
+func (ur *UserRepository) UpdateRole(ctx context.Context, id int, role domain.Role) error {
+	res, err := ur.db.ExecContext(ctx, "UPDATE users SET role=$1 WHERE id=$2", role, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return domain.ErrUserNotFound
+	}
+
+	log.WithFields(log.Fields{"id": id, "role": role}).Info("Repository: UpdateRole")
+
+	return nil
+}
+
+func (ur *UserRepository) UpdatePassword(ctx context.Context, id int, password string) error {
+	_, err := ur.db.ExecContext(ctx, "UPDATE users SET password=$1 WHERE id=$2", password, id)
+
+	log.WithField("id", id).Info("Repository: UpdatePassword")
+
+	return err
+}
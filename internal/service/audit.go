@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	logger "github.com/jackietana/grpc-logger/pkg/domain"
+	log "github.com/sirupsen/logrus"
+)
+
+type LoggerClient interface {
+	SendLogRequest(ctx context.Context, req logger.LogItem) error
+}
+
+type auditMetrics interface {
+	LoggerSendFailure()
+}
+
+// auditor sends audit events to the gRPC logger. A failed send is logged
+// and counted but never fails the operation being audited.
+type auditor struct {
+	client  LoggerClient
+	metrics auditMetrics
+}
+
+func (a auditor) send(ctx context.Context, action, entity string, entityId int) {
+	if err := a.client.SendLogRequest(ctx, logger.LogItem{
+		Action:    action,
+		Entity:    entity,
+		EntityID:  int64(entityId),
+		Timestamp: time.Now(),
+	}); err != nil {
+		a.metrics.LoggerSendFailure()
+
+		actorId, _ := domain.UserIDFromContext(ctx)
+		log.WithFields(log.Fields{
+			"service":   "audit",
+			"action":    action,
+			"entity":    entity,
+			"entity_id": entityId,
+			"actor_id":  actorId,
+		}).Error(err)
+	}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jackietana/crud-app/internal/domain"
+)
+
+// bookEventBuffer is how many events a watcher may fall behind before it
+// is dropped.
+const bookEventBuffer = 64
+
+// bookEvents fans book changes out to watchers in this instance.
+type bookEvents struct {
+	mu       sync.Mutex
+	watchers map[chan domain.BookEvent]struct{}
+}
+
+func newBookEvents() *bookEvents {
+	return &bookEvents{watchers: make(map[chan domain.BookEvent]struct{})}
+}
+
+// watch returns a channel of events published until ctx is done. The
+// channel is closed then, or earlier if the watcher falls behind.
+func (e *bookEvents) watch(ctx context.Context) <-chan domain.BookEvent {
+	ch := make(chan domain.BookEvent, bookEventBuffer)
+
+	e.mu.Lock()
+	e.watchers[ch] = struct{}{}
+	e.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		e.remove(ch)
+	}()
+
+	return ch
+}
+
+func (e *bookEvents) publish(ev domain.BookEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for ch := range e.watchers {
+		select {
+		case ch <- ev:
+		default:
+			delete(e.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (e *bookEvents) remove(ch chan domain.BookEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.watchers[ch]; ok {
+		delete(e.watchers, ch)
+		close(ch)
+	}
+}
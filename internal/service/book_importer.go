@@ -0,0 +1,291 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxImportBatch keeps a multi-row insert under the postgres limit of
+// 65535 parameters.
+const maxImportBatch = 10000
+
+type ImportConfig struct {
+	BatchSize int
+	// MaxErrors caps the failed rows listed in a result.
+	MaxErrors int
+	// JobTTL is how long finished jobs can be looked up.
+	JobTTL time.Duration
+}
+
+// BookImporter loads books in bulk, in the request or as a background
+// job. Jobs are kept in memory: their status is only known to the
+// instance that runs them.
+type BookImporter struct {
+	books *BookService
+	cfg   ImportConfig
+
+	mu   sync.Mutex
+	jobs map[string]*importJob
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+type importJob struct {
+	job       domain.ImportJob
+	processed atomic.Int64
+}
+
+func NewBookImporter(books *BookService, cfg ImportConfig) *BookImporter {
+	if cfg.BatchSize <= 0 || cfg.BatchSize > maxImportBatch {
+		cfg.BatchSize = maxImportBatch
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &BookImporter{
+		books:  books,
+		cfg:    cfg,
+		jobs:   make(map[string]*importJob),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// ImportBooks reads the source to the end and stores its valid rows in
+// a single transaction. Rows that fail validation are reported and left
+// out; a read or database error fails the whole import.
+func (bi *BookImporter) ImportBooks(ctx context.Context, src domain.BookSource,
+	opts domain.ImportOptions) (result domain.ImportResult, err error) {
+	ctx, span := tracer.Start(ctx, "BookImporter.ImportBooks", trace.WithAttributes(
+		attribute.String("import.mode", opts.Mode),
+		attribute.Bool("import.dry_run", opts.DryRun),
+	))
+	defer func() { endSpan(span, err) }()
+
+	return bi.importBooks(ctx, src, opts, new(atomic.Int64))
+}
+
+// StartImport runs the import as a background job and returns it. The
+// job keeps the user of ctx but not its deadline. release is called
+// once the source has been read.
+func (bi *BookImporter) StartImport(ctx context.Context, src domain.BookSource, opts domain.ImportOptions,
+	release func()) (domain.ImportJob, error) {
+	if err := opts.Normalize(); err != nil {
+		release()
+		return domain.ImportJob{}, err
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		release()
+		return domain.ImportJob{}, err
+	}
+
+	j := &importJob{job: domain.ImportJob{ID: id, Status: domain.ImportJobRunning, CreatedAt: time.Now()}}
+
+	bi.mu.Lock()
+	bi.dropExpiredJobs()
+	bi.jobs[id] = j
+	bi.mu.Unlock()
+
+	// the job outlives the request, but is stopped by Close
+	jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(bi.ctx, cancel)
+
+	bi.running.Add(1)
+	go func() {
+		defer bi.running.Done()
+		defer stop()
+		defer cancel()
+
+		jobCtx, span := tracer.Start(jobCtx, "BookImporter.job", trace.WithAttributes(attribute.String("import.job", id)))
+		result, err := bi.importBooks(jobCtx, src, opts, &j.processed)
+		endSpan(span, err)
+		release()
+
+		finished := time.Now()
+
+		bi.mu.Lock()
+		j.job.FinishedAt = &finished
+		if err != nil {
+			j.job.Status, j.job.Error = domain.ImportJobFailed, err.Error()
+		} else {
+			j.job.Status, j.job.Result = domain.ImportJobDone, &result
+		}
+		bi.mu.Unlock()
+
+		log.WithFields(log.Fields{"service": "import", "job": id, "status": j.job.Status}).Info("Service: import job")
+	}()
+
+	return bi.snapshot(j), nil
+}
+
+func (bi *BookImporter) GetImportJob(ctx context.Context, id string) (domain.ImportJob, error) {
+	bi.mu.Lock()
+	bi.dropExpiredJobs()
+	j, ok := bi.jobs[id]
+	bi.mu.Unlock()
+
+	if !ok {
+		return domain.ImportJob{}, domain.ErrImportJobNotFound
+	}
+
+	return bi.snapshot(j), nil
+}
+
+// Close cancels the running jobs, which roll back, and waits for them.
+func (bi *BookImporter) Close(ctx context.Context) error {
+	bi.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		bi.running.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (bi *BookImporter) importBooks(ctx context.Context, src domain.BookSource, opts domain.ImportOptions,
+	processed *atomic.Int64) (domain.ImportResult, error) {
+	if err := opts.Normalize(); err != nil {
+		return domain.ImportResult{}, err
+	}
+
+	result := domain.ImportResult{DryRun: opts.DryRun, Errors: make([]domain.ImportRowError, 0)}
+
+	var (
+		// carry is a row held back for the next batch: an upsert batch
+		// must not hold the same natural key twice
+		carry *domain.Book
+		eof   bool
+	)
+
+	next := func() ([]domain.Book, error) {
+		batch := make([]domain.Book, 0, bi.cfg.BatchSize)
+		keys := make(map[string]bool)
+
+		if carry != nil {
+			batch = append(batch, *carry)
+			keys[naturalKey(*carry)] = true
+			carry = nil
+		}
+
+		for !eof && len(batch) < bi.cfg.BatchSize {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			row, err := src.Next()
+			if errors.Is(err, io.EOF) {
+				eof = true
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			result.Rows++
+			processed.Add(1)
+
+			if row.Err == nil {
+				row.Err = row.Book.ValidateImport()
+			}
+
+			if row.Err != nil {
+				result.Failed++
+				if len(result.Errors) < bi.cfg.MaxErrors {
+					result.Errors = append(result.Errors, domain.ImportRowError{Line: row.Line, Error: row.Err.Error()})
+				}
+				continue
+			}
+
+			if opts.Mode == domain.ImportModeUpsert {
+				key := naturalKey(row.Book)
+				if keys[key] {
+					carry = &row.Book
+					break
+				}
+
+				keys[key] = true
+			}
+
+			batch = append(batch, row.Book)
+		}
+
+		return batch, nil
+	}
+
+	inserted, updated, err := bi.books.repo.ImportBooks(ctx, opts, next)
+	if err != nil {
+		return result, err
+	}
+
+	result.Inserted, result.Updated = len(inserted), len(updated)
+
+	if !opts.DryRun {
+		bi.books.invalidate(ctx)
+
+		now := time.Now()
+		for _, id := range inserted {
+			bi.books.events.publish(domain.BookEvent{Type: domain.BookCreated, ID: id, Timestamp: now})
+		}
+		for _, id := range updated {
+			bi.books.cacher.DeleteCachedBook(ctx, id)
+			bi.books.events.publish(domain.BookEvent{Type: domain.BookUpdated, ID: id, Timestamp: now})
+		}
+	}
+
+	return result, nil
+}
+
+func (bi *BookImporter) snapshot(j *importJob) domain.ImportJob {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+
+	job := j.job
+	job.Processed = int(j.processed.Load())
+
+	return job
+}
+
+// dropExpiredJobs forgets jobs finished longer than JobTTL ago. The
+// caller holds mu.
+func (bi *BookImporter) dropExpiredJobs() {
+	for id, j := range bi.jobs {
+		if j.job.FinishedAt != nil && time.Since(*j.job.FinishedAt) > bi.cfg.JobTTL {
+			delete(bi.jobs, id)
+		}
+	}
+}
+
+func naturalKey(b domain.Book) string {
+	return strings.ToLower(b.Name) + "\x00" + strings.ToLower(b.Author)
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// GetRevisions lists the revisions of a book, newest first.
+func (bs *BookService) GetRevisions(ctx context.Context, id, limit, offset int) (page domain.BookRevisionPage, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.GetRevisions", trace.WithAttributes(attribute.Int("book.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	if limit <= 0 {
+		limit = domain.DefaultBooksLimit
+	}
+	if limit > domain.MaxBooksLimit {
+		limit = domain.MaxBooksLimit
+	}
+	if offset < 0 {
+		return page, domain.ErrInvalidBookQuery
+	}
+
+	return bs.repo.GetRevisions(ctx, id, limit, offset)
+}
+
+func (bs *BookService) GetRevision(ctx context.Context, id, rev int) (r domain.BookRevision, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.GetRevision", trace.WithAttributes(
+		attribute.Int("book.id", id),
+		attribute.Int("book.revision", rev),
+	))
+	defer func() { endSpan(span, err) }()
+
+	return bs.repo.GetRevision(ctx, id, rev)
+}
+
+// DiffRevisions lists the fields changed from one revision to another.
+// from may be newer than to, the diff then goes back in time.
+func (bs *BookService) DiffRevisions(ctx context.Context, id, from, to int) (diff domain.BookDiff, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.DiffRevisions", trace.WithAttributes(attribute.Int("book.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	fromRev, err := bs.repo.GetRevision(ctx, id, from)
+	if err != nil {
+		return diff, err
+	}
+
+	toRev, err := bs.repo.GetRevision(ctx, id, to)
+	if err != nil {
+		return diff, err
+	}
+
+	return domain.BookDiff{
+		BookID:  id,
+		From:    from,
+		To:      to,
+		Changes: domain.DiffBooks(fromRev.Book, toRev.Book),
+	}, nil
+}
+
+// RevertBook puts the fields of a revision back into the book, as a new
+// revision. The version works as for DeleteBook.
+func (bs *BookService) RevertBook(ctx context.Context, id, rev, version int) (book domain.Book, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.RevertBook", trace.WithAttributes(
+		attribute.Int("book.id", id),
+		attribute.Int("book.revision", rev),
+	))
+	defer func() { endSpan(span, err) }()
+
+	book, err = bs.repo.RevertBook(ctx, id, rev, version)
+	if err != nil {
+		return book, err
+	}
+
+	bs.invalidate(ctx)
+	bs.cacher.UpdateCachedBook(ctx, id, book)
+	bs.events.publish(domain.BookEvent{Type: domain.BookUpdated, ID: id, Book: &book, Timestamp: time.Now()})
+
+	return book, nil
+}
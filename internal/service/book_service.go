@@ -2,68 +2,349 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/jackietana/crud-app/internal/domain"
-	"github.com/jackietana/crud-app/pkg/cache"
+	logger "github.com/jackietana/grpc-logger/pkg/domain"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type BookRepository interface {
 	GetBookById(ctx context.Context, id int) (domain.Book, error)
-	GetBooks(ctx context.Context) ([]domain.Book, error)
-	CreateBook(ctx context.Context, book domain.Book) error
-	DeleteBook(ctx context.Context, id int) error
-	UpdateBook(ctx context.Context, id int, book domain.Book) error
+	GetBooks(ctx context.Context, q domain.BookQuery) (domain.BookPage, error)
+	SearchBooks(ctx context.Context, q domain.BookSearchQuery) (domain.BookSearchPage, error)
+	CreateBook(ctx context.Context, book domain.Book) (domain.Book, error)
+	DeleteBook(ctx context.Context, id, version int) error
+	UpdateBook(ctx context.Context, id int, book domain.Book, version int) (domain.Book, error)
+	PatchBook(ctx context.Context, id int, patch domain.BookPatch, version int) (domain.Book, error)
+	PurgeBook(ctx context.Context, id, version int) error
+	PurgeDeleted(ctx context.Context, before time.Time) ([]int, error)
+	RestoreBook(ctx context.Context, id int) (domain.Book, error)
+	GetTrash(ctx context.Context, limit, offset int) (domain.BookPage, error)
+	GetRevisions(ctx context.Context, id, limit, offset int) (domain.BookRevisionPage, error)
+	GetRevision(ctx context.Context, id, rev int) (domain.BookRevision, error)
+	RevertBook(ctx context.Context, id, rev, version int) (domain.Book, error)
+	ImportBooks(ctx context.Context, opts domain.ImportOptions,
+		next func() ([]domain.Book, error)) (inserted, updated []int, err error)
+	ExportBooks(ctx context.Context, q domain.BookQuery, fn func(domain.Book) error) error
+}
+
+// BookCache keeps books and book listings between reads. Lookups that
+// miss return an error. Writes to the cache cannot fail the operation,
+// implementations deal with their own errors.
+//
+// A lookup also returns the cache generation it saw, and the fill after a
+// miss passes it back: a cache shared between instances then drops the
+// fill if any of them invalidated it since.
+type BookCache interface {
+	GetCachedBook(ctx context.Context, id int) (domain.Book, int64, error)
+	AddBook(ctx context.Context, gen int64, book domain.Book)
+	UpdateCachedBook(ctx context.Context, id int, book domain.Book)
+	DeleteCachedBook(ctx context.Context, id int)
+	GetCachedBooks(ctx context.Context, q domain.BookQuery) (domain.BookPage, int64, error)
+	AddBooks(ctx context.Context, q domain.BookQuery, gen int64, page domain.BookPage)
+	// UpdateCacher drops every cached listing.
+	UpdateCacher(ctx context.Context)
+	// Flush drops every cached book and listing.
+	Flush(ctx context.Context) error
+	Stats(ctx context.Context) domain.CacheStats
+}
+
+type BookMetrics interface {
+	LoggerSendFailure()
 }
 
 type BookService struct {
-	repo   BookRepository
-	cacher *cache.CacheHandler
+	repo    BookRepository
+	cacher  BookCache
+	fills   *cacheFiller
+	auditor auditor
+	events  *bookEvents
+
+	// auditReads turns on GET events for single book reads
+	auditReads bool
 }
 
-func NewBookService(repo BookRepository) *BookService {
-	return &BookService{repo, cache.NewCacheHandler()}
+func NewBookService(repo BookRepository, cacher BookCache, logger LoggerClient, metrics BookMetrics,
+	auditReads bool) *BookService {
+	return &BookService{repo, cacher, new(cacheFiller), auditor{logger, metrics}, newBookEvents(), auditReads}
 }
 
-func (bs *BookService) GetBooks(ctx context.Context) ([]domain.Book, error) {
-	books, err := bs.cacher.GetCachedBooks()
+// invalidate runs after every committed book write. It drops the cached
+// listings and keeps reads still in flight from caching what they read
+// before the write.
+func (bs *BookService) invalidate(ctx context.Context) {
+	bs.fills.written()
+	bs.cacher.UpdateCacher(ctx)
+}
+
+func (bs *BookService) GetBooks(ctx context.Context, q domain.BookQuery) (page domain.BookPage, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.GetBooks")
+	defer func() { endSpan(span, err) }()
+
+	if err := q.Normalize(); err != nil {
+		return domain.BookPage{}, err
+	}
+
+	endCacheSpan := startCacheSpan(ctx, "cache.GetCachedBooks")
+	page, gen, err := bs.cacher.GetCachedBooks(ctx, q)
+	endCacheSpan(err == nil)
 	if err == nil {
-		return books, err
+		return page, err
+	}
+
+	return load(ctx, bs.fills, q.CacheKey(),
+		func(ctx context.Context) (domain.BookPage, error) {
+			return bs.repo.GetBooks(ctx, q)
+		},
+		func(ctx context.Context, page domain.BookPage) {
+			bs.cacher.AddBooks(ctx, q, gen, page)
+		})
+}
+
+// ExportBooks calls fn with every book the query filters select, in the
+// query order, without loading them all at once. Exports skip the cache.
+func (bs *BookService) ExportBooks(ctx context.Context, q domain.BookQuery, fn func(domain.Book) error) (err error) {
+	ctx, span := tracer.Start(ctx, "BookService.ExportBooks")
+	defer func() { endSpan(span, err) }()
+
+	if err := q.Normalize(); err != nil {
+		return err
 	}
 
-	books, err = bs.repo.GetBooks(ctx)
-	bs.cacher.AddBooks(books)
+	return bs.repo.ExportBooks(ctx, q, fn)
+}
+
+func (bs *BookService) SearchBooks(ctx context.Context, q domain.BookSearchQuery) (page domain.BookSearchPage, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.SearchBooks")
+	defer func() { endSpan(span, err) }()
 
-	return books, err
+	if err := q.Normalize(); err != nil {
+		return domain.BookSearchPage{}, err
+	}
+
+	return bs.repo.SearchBooks(ctx, q)
 }
 
-func (bs *BookService) GetBookById(ctx context.Context, id int) (domain.Book, error) {
-	book, err := bs.cacher.GetCachedBook(id)
-	if err == nil {
+func (bs *BookService) GetBookById(ctx context.Context, id int) (book domain.Book, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.GetBookById", trace.WithAttributes(attribute.Int("book.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	endCacheSpan := startCacheSpan(ctx, "cache.GetCachedBook")
+	book, gen, err := bs.cacher.GetCachedBook(ctx, id)
+	endCacheSpan(err == nil)
+	if err != nil {
+		book, err = load(ctx, bs.fills, fmt.Sprintf("book_%d", id),
+			func(ctx context.Context) (domain.Book, error) {
+				return bs.repo.GetBookById(ctx, id)
+			},
+			func(ctx context.Context, book domain.Book) {
+				bs.cacher.AddBook(ctx, gen, book)
+			})
+		if err != nil {
+			return book, err
+		}
+	}
+
+	if bs.auditReads {
+		bs.auditor.send(ctx, logger.ACTION_GET, logger.ENTITY_BOOK, id)
+	}
+
+	return book, nil
+}
+
+func (bs *BookService) CreateBook(ctx context.Context, book domain.Book) (created domain.Book, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.CreateBook")
+	defer func() { endSpan(span, err) }()
+
+	created, err = bs.repo.CreateBook(ctx, book)
+	if err != nil {
+		return created, err
+	}
+
+	bs.invalidate(ctx)
+	bs.events.publish(domain.BookEvent{Type: domain.BookCreated, ID: created.ID, Book: &created, Timestamp: time.Now()})
+
+	return created, nil
+}
+
+// DeleteBook moves the book to the trash. A version other than 0 makes
+// the delete conditional: it fails with ErrVersionMismatch if the book
+// has changed.
+func (bs *BookService) DeleteBook(ctx context.Context, id, version int) (err error) {
+	ctx, span := tracer.Start(ctx, "BookService.DeleteBook", trace.WithAttributes(attribute.Int("book.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	if err = bs.repo.DeleteBook(ctx, id, version); err != nil {
+		return err
+	}
+
+	bs.invalidate(ctx)
+	bs.cacher.DeleteCachedBook(ctx, id)
+	bs.events.publish(domain.BookEvent{Type: domain.BookDeleted, ID: id, Timestamp: time.Now()})
+
+	return nil
+}
+
+// PurgeBook deletes the book for good, from the trash or not. The version
+// works as for DeleteBook.
+func (bs *BookService) PurgeBook(ctx context.Context, id, version int) (err error) {
+	ctx, span := tracer.Start(ctx, "BookService.PurgeBook", trace.WithAttributes(attribute.Int("book.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	if err = bs.repo.PurgeBook(ctx, id, version); err != nil {
+		return err
+	}
+
+	bs.invalidate(ctx)
+	bs.cacher.DeleteCachedBook(ctx, id)
+	bs.events.publish(domain.BookEvent{Type: domain.BookDeleted, ID: id, Timestamp: time.Now()})
+
+	return nil
+}
+
+// PurgeTrash deletes the books moved to the trash before the given time
+// and returns how many there were. Watchers were told about them when
+// they were moved to the trash.
+func (bs *BookService) PurgeTrash(ctx context.Context, before time.Time) (n int, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.PurgeTrash")
+	defer func() { endSpan(span, err) }()
+
+	ids, err := bs.repo.PurgeDeleted(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		bs.cacher.DeleteCachedBook(ctx, id)
+	}
+
+	return len(ids), nil
+}
+
+// RestoreBook takes the book out of the trash. Watchers see it created
+// again.
+func (bs *BookService) RestoreBook(ctx context.Context, id int) (book domain.Book, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.RestoreBook", trace.WithAttributes(attribute.Int("book.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	book, err = bs.repo.RestoreBook(ctx, id)
+	if err != nil {
 		return book, err
 	}
 
-	book, err = bs.repo.GetBookById(ctx, id)
-	if err == nil {
-		bs.cacher.AddBook(book)
+	bs.invalidate(ctx)
+	bs.events.publish(domain.BookEvent{Type: domain.BookCreated, ID: id, Book: &book, Timestamp: time.Now()})
+
+	return book, nil
+}
+
+// GetTrash lists the books in the trash. Trash pages are not cached.
+func (bs *BookService) GetTrash(ctx context.Context, limit, offset int) (page domain.BookPage, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.GetTrash")
+	defer func() { endSpan(span, err) }()
+
+	if limit <= 0 {
+		limit = domain.DefaultBooksLimit
+	}
+	if limit > domain.MaxBooksLimit {
+		limit = domain.MaxBooksLimit
+	}
+	if offset < 0 {
+		return page, domain.ErrInvalidBookQuery
 	}
 
-	return book, err
+	return bs.repo.GetTrash(ctx, limit, offset)
 }
 
-func (bs *BookService) CreateBook(ctx context.Context, book domain.Book) error {
-	bs.cacher.UpdateCacher()
+// UpdateBook overwrites the book and returns it with its new version.
+// A version other than 0 makes the update conditional, as for DeleteBook.
+func (bs *BookService) UpdateBook(ctx context.Context, id int, book domain.Book,
+	version int) (updated domain.Book, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.UpdateBook", trace.WithAttributes(attribute.Int("book.id", id)))
+	defer func() { endSpan(span, err) }()
 
-	return bs.repo.CreateBook(ctx, book)
+	updated, err = bs.repo.UpdateBook(ctx, id, book, version)
+	if err != nil {
+		return updated, err
+	}
+
+	bs.invalidate(ctx)
+	bs.cacher.UpdateCachedBook(ctx, id, updated)
+	bs.events.publish(domain.BookEvent{Type: domain.BookUpdated, ID: id, Book: &updated, Timestamp: time.Now()})
+
+	return updated, nil
 }
 
-func (bs *BookService) DeleteBook(ctx context.Context, id int) error {
-	bs.cacher.DeleteCachedBook(id)
+// PatchBook applies patch to the stored book and writes only the fields
+// it changed. The patched book is returned. A version other than 0 makes
+// the patch conditional, as for DeleteBook; either way the write fails if
+// the book changes while the patch is applied.
+func (bs *BookService) PatchBook(ctx context.Context, id, version int,
+	patch func(domain.Book) (domain.Book, error)) (book domain.Book, err error) {
+	ctx, span := tracer.Start(ctx, "BookService.PatchBook", trace.WithAttributes(attribute.Int("book.id", id)))
+	defer func() { endSpan(span, err) }()
 
-	return bs.repo.DeleteBook(ctx, id)
+	// patches apply to the stored book, a cached copy may be stale
+	current, err := bs.repo.GetBookById(ctx, id)
+	if err != nil {
+		return book, err
+	}
+
+	if version != 0 && current.Version != version {
+		return book, domain.ErrVersionMismatch
+	}
+
+	book, err = patch(current)
+	if err != nil {
+		return book, err
+	}
+
+	book.ID, book.PublishedAt, book.Version = current.ID, current.PublishedAt, current.Version
+	if err = book.Validate(); err != nil {
+		return book, err
+	}
+
+	changes := domain.NewBookPatch(current, book)
+	if changes.Empty() {
+		return book, nil
+	}
+
+	book, err = bs.repo.PatchBook(ctx, id, changes, current.Version)
+	if err != nil {
+		return book, err
+	}
+
+	bs.invalidate(ctx)
+	bs.cacher.UpdateCachedBook(ctx, id, book)
+	bs.events.publish(domain.BookEvent{Type: domain.BookUpdated, ID: id, Book: &book, Timestamp: time.Now()})
+
+	return book, nil
+}
+
+// WatchBooks streams book changes made through this instance until ctx
+// is done. The channel is closed early if the caller falls behind.
+func (bs *BookService) WatchBooks(ctx context.Context) <-chan domain.BookEvent {
+	return bs.events.watch(ctx)
+}
+
+// CacheStats reports the size and hit rate of the book cache.
+func (bs *BookService) CacheStats(ctx context.Context) domain.CacheStats {
+	return bs.cacher.Stats(ctx)
 }
 
-func (bs *BookService) UpdateBook(ctx context.Context, id int, book domain.Book) error {
-	bs.cacher.UpdateCachedBook(id, book)
+// FlushCache drops every cached book and listing.
+func (bs *BookService) FlushCache(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "BookService.FlushCache")
+	defer func() { endSpan(span, err) }()
+
+	return bs.cacher.Flush(ctx)
+}
 
-	return bs.repo.UpdateBook(ctx, id, book)
+// EvictCachedBook drops the book from the cache, it is read from the
+// database next time.
+func (bs *BookService) EvictCachedBook(ctx context.Context, id int) {
+	bs.cacher.DeleteCachedBook(ctx, id)
 }
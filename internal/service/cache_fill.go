@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheFiller reads through the cache on misses. Concurrent misses for
+// the same key share one database read, and a read only fills the cache
+// if no write was committed while it ran: what it read may predate the
+// write and would stay cached until it expires.
+type cacheFiller struct {
+	group singleflight.Group
+
+	// fills hold mu for reading while they check writes and add to the
+	// cache, so a write is either counted before the check or cleaned up
+	// after the add
+	mu     sync.RWMutex
+	writes uint64
+}
+
+// written counts a committed write. The caller drops the cache entries
+// the write affected afterwards.
+func (f *cacheFiller) written() {
+	f.mu.Lock()
+	f.writes++
+	f.mu.Unlock()
+}
+
+func (f *cacheFiller) writeCount() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.writes
+}
+
+// load calls read, shared with the concurrent callers of the same key,
+// and passes its result to add unless a write was counted meanwhile.
+// The read runs on for the others when ctx is done.
+func load[T any](ctx context.Context, f *cacheFiller, key string,
+	read func(context.Context) (T, error), add func(context.Context, T)) (T, error) {
+	writes := f.writeCount()
+
+	// a key per write count: callers arriving after a write do not join
+	// a read that started before it
+	res := f.group.DoChan(fmt.Sprintf("%s@%d", key, writes), func() (interface{}, error) {
+		ctx := context.WithoutCancel(ctx)
+
+		v, err := read(ctx)
+		if err != nil {
+			return v, err
+		}
+
+		f.mu.RLock()
+		if f.writes == writes {
+			add(ctx, v)
+		}
+		f.mu.RUnlock()
+
+		return v, nil
+	})
+
+	select {
+	case r := <-res:
+		if r.Err != nil {
+			var zero T
+			return zero, r.Err
+		}
+		return r.Val.(T), nil
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
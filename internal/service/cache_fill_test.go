@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadSharesConcurrentMisses(t *testing.T) {
+	var (
+		f       cacheFiller
+		reads   atomic.Int32
+		adds    atomic.Int32
+		release = make(chan struct{})
+	)
+
+	read := func(context.Context) (int, error) {
+		reads.Add(1)
+		<-release
+		return 42, nil
+	}
+	add := func(context.Context, int) { adds.Add(1) }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			v, err := load(context.Background(), &f, "book_1", read, add)
+			if err != nil || v != 42 {
+				t.Errorf("load returned %d, %v", v, err)
+			}
+		}()
+	}
+
+	// let the callers join the read before it returns
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := reads.Load(); n != 1 {
+		t.Errorf("%d reads for concurrent misses, want 1", n)
+	}
+	if n := adds.Load(); n != 1 {
+		t.Errorf("%d adds for concurrent misses, want 1", n)
+	}
+}
+
+// TestLoadSkipsFillAfterWrite checks that a read racing a write does not
+// cache what it read, and that callers after the write read again.
+func TestLoadSkipsFillAfterWrite(t *testing.T) {
+	var (
+		f       cacheFiller
+		added   []int
+		mu      sync.Mutex
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	add := func(_ context.Context, v int) {
+		mu.Lock()
+		added = append(added, v)
+		mu.Unlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		v, err := load(context.Background(), &f, "book_1", func(context.Context) (int, error) {
+			close(started)
+			<-release
+			return 1, nil
+		}, add)
+		if err != nil || v != 1 {
+			t.Errorf("stale load returned %d, %v", v, err)
+		}
+	}()
+
+	<-started
+	f.written()
+
+	v, err := load(context.Background(), &f, "book_1", func(context.Context) (int, error) {
+		return 2, nil
+	}, add)
+	if err != nil || v != 2 {
+		t.Errorf("load after the write returned %d, %v, want a fresh read", v, err)
+	}
+
+	close(release)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(added) != 1 || added[0] != 2 {
+		t.Errorf("cache filled with %v, want only the read after the write", added)
+	}
+}
+
+func TestLoadConcurrentWrites(t *testing.T) {
+	var (
+		f     cacheFiller
+		mu    sync.Mutex
+		value int
+		// cached is what the cache would hold, dropped on every write
+		cached *int
+	)
+
+	read := func(context.Context) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return value, nil
+	}
+	add := func(_ context.Context, v int) {
+		mu.Lock()
+		cached = &v
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				load(context.Background(), &f, "book_1", read, add)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				mu.Lock()
+				value++
+				mu.Unlock()
+
+				f.written()
+
+				mu.Lock()
+				cached = nil
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cached != nil && *cached != value {
+		t.Errorf("cache holds %d after the last write set %d", *cached, value)
+	}
+}
+
+func TestLoadReturnsOnCancel(t *testing.T) {
+	var f cacheFiller
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := load(ctx, &f, "book_1", func(ctx context.Context) (int, error) {
+			<-release
+			return 1, ctx.Err()
+		}, func(context.Context, int) {})
+		errc <- err
+	}()
+
+	cancel()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("load returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("load did not return when its context was canceled")
+	}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	log "github.com/sirupsen/logrus"
+)
+
+// BookChangeListener delivers the book changes committed by any instance
+// until it is closed.
+type BookChangeListener interface {
+	Changes() <-chan domain.BookChange
+	Close() error
+}
+
+// CacheInvalidator drops cached books as the database announces their
+// changes, so an instance does not serve books changed through another
+// one. When changes may have been missed it flushes the whole cache.
+// Changes made through this instance come back too and are dropped
+// again, at the cost of a cache miss.
+type CacheInvalidator struct {
+	books    *BookService
+	listener BookChangeListener
+
+	stopped chan struct{}
+}
+
+func NewCacheInvalidator(books *BookService, listener BookChangeListener) *CacheInvalidator {
+	inv := &CacheInvalidator{
+		books:    books,
+		listener: listener,
+		stopped:  make(chan struct{}),
+	}
+
+	go inv.run()
+
+	return inv
+}
+
+// Close stops listening, after the change being applied.
+func (inv *CacheInvalidator) Close(ctx context.Context) error {
+	if err := inv.listener.Close(); err != nil {
+		return err
+	}
+
+	select {
+	case <-inv.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (inv *CacheInvalidator) run() {
+	defer close(inv.stopped)
+
+	for change := range inv.listener.Changes() {
+		if err := inv.books.BookChanged(context.Background(), change); err != nil {
+			log.WithField("service", "cache invalidator").Error(err)
+		}
+	}
+}
+
+// BookChanged drops the cached copy of a book changed through any
+// instance, along with the cached listings. A missed change flushes the
+// cache.
+func (bs *BookService) BookChanged(ctx context.Context, change domain.BookChange) error {
+	bs.fills.written()
+
+	if change.Missed {
+		log.WithField("service", "cache invalidator").Warn("book changes may have been missed, flushing the cache")
+		return bs.cacher.Flush(ctx)
+	}
+
+	bs.cacher.UpdateCacher(ctx)
+	bs.cacher.DeleteCachedBook(ctx, change.ID)
+
+	return nil
+}
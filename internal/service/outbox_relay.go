@@ -0,0 +1,271 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	logger "github.com/jackietana/grpc-logger/pkg/domain"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// outboxStuckLimit caps the stuck events listed in the outbox status.
+const outboxStuckLimit = 100
+
+type OutboxRepository interface {
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]domain.OutboxEvent, error)
+	MarkSent(ctx context.Context, id int64) error
+	MarkFailed(ctx context.Context, id int64, reason string, retryAfter time.Duration) error
+	Release(ctx context.Context, ids []int64) error
+	GetStatus(ctx context.Context, stuckAfter time.Duration, limit int) (domain.OutboxStatus, error)
+	DeleteSent(ctx context.Context, before time.Time) (int64, error)
+}
+
+type OutboxConfig struct {
+	PollInterval time.Duration
+	BatchSize    int
+	// Lease is how long a claimed event is reserved for this relay
+	// before another one may pick it up. It should allow for several
+	// sends: events of a batch that would outlast it are released.
+	Lease       time.Duration
+	SendTimeout time.Duration
+
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// StuckAfter is the age after which a pending event is reported as stuck.
+	StuckAfter time.Duration
+	// Retention is how long sent events are kept.
+	Retention time.Duration
+}
+
+// OutboxRelay publishes events from the outbox to the sinks and marks
+// them sent. An event is marked sent only after every sink took it, so
+// delivery is at least once: sinks may see an event more than once.
+type OutboxRelay struct {
+	repo    OutboxRepository
+	sinks   []LoggerClient
+	cfg     OutboxConfig
+	metrics auditMetrics
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewOutboxRelay(repo OutboxRepository, cfg OutboxConfig, metrics auditMetrics, sinks ...LoggerClient) *OutboxRelay {
+	if cfg.Lease < 2*cfg.SendTimeout {
+		log.WithFields(log.Fields{
+			"lease":        cfg.Lease,
+			"send_timeout": cfg.SendTimeout,
+		}).Warn("Service: outbox lease is shorter than two send timeouts, no event will be sent")
+	}
+
+	r := &OutboxRelay{
+		repo:    repo,
+		sinks:   sinks,
+		cfg:     cfg,
+		metrics: metrics,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go r.run()
+
+	return r
+}
+
+// GetStatus reports the number of pending events and lists the stuck ones.
+func (r *OutboxRelay) GetStatus(ctx context.Context) (status domain.OutboxStatus, err error) {
+	ctx, span := tracer.Start(ctx, "OutboxRelay.GetStatus")
+	defer func() { endSpan(span, err) }()
+
+	return r.repo.GetStatus(ctx, r.cfg.StuckAfter, outboxStuckLimit)
+}
+
+// Close stops the relay after the batch in progress. Events left pending
+// are published on the next start or by another instance.
+func (r *OutboxRelay) Close(ctx context.Context) error {
+	r.closeOnce.Do(func() { close(r.done) })
+
+	select {
+	case <-r.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *OutboxRelay) run() {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.relay()
+		case <-cleanup.C:
+			r.deleteSent()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// relay publishes claimed batches until the outbox has no more events
+// due, a batch outlasts its lease or the relay is stopped.
+func (r *OutboxRelay) relay() {
+	for {
+		// the lease starts in the database, after this
+		leaseEnd := time.Now().Add(r.cfg.Lease)
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.cfg.SendTimeout)
+		events, err := r.repo.Claim(ctx, r.cfg.BatchSize, r.cfg.Lease)
+		cancel()
+
+		if err != nil {
+			log.WithField("service", "outbox").Error(err)
+			return
+		}
+
+		for i, ev := range events {
+			// an event is sent and marked within two send timeouts; one
+			// that could outlast the lease would be claimed and sent by
+			// another relay meanwhile
+			if time.Until(leaseEnd) < 2*r.cfg.SendTimeout {
+				r.release(events[i:])
+				return
+			}
+
+			r.publish(ev)
+		}
+
+		if len(events) < r.cfg.BatchSize {
+			return
+		}
+
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+	}
+}
+
+func (r *OutboxRelay) publish(ev domain.OutboxEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.SendTimeout)
+	defer cancel()
+
+	ctx, span := tracer.Start(ctx, "OutboxRelay.publish", trace.WithAttributes(
+		attribute.Int64("outbox.id", ev.ID),
+		attribute.String("outbox.action", ev.Action),
+		attribute.String("outbox.entity", ev.Entity),
+	))
+
+	err := r.send(ctx, ev)
+	endSpan(span, err)
+
+	// a send that timed out must not keep the outcome from being recorded
+	ctx, cancelMark := context.WithTimeout(context.Background(), r.cfg.SendTimeout)
+	defer cancelMark()
+
+	if err != nil {
+		r.metrics.LoggerSendFailure()
+		log.WithFields(log.Fields{
+			"service":   "outbox",
+			"id":        ev.ID,
+			"action":    ev.Action,
+			"entity":    ev.Entity,
+			"entity_id": ev.EntityID,
+			"attempts":  ev.Attempts,
+		}).Error(err)
+
+		if err := r.repo.MarkFailed(ctx, ev.ID, err.Error(), r.retryDelay(ev.Attempts)); err != nil {
+			log.WithFields(log.Fields{"service": "outbox", "id": ev.ID}).Error(err)
+		}
+		return
+	}
+
+	if err := r.repo.MarkSent(ctx, ev.ID); err != nil {
+		// the lease runs out and the event is published again
+		log.WithFields(log.Fields{"service": "outbox", "id": ev.ID}).Error(err)
+	}
+}
+
+// release hands back events the lease leaves no time for, so the next
+// poll, on this instance or another, claims them right away.
+func (r *OutboxRelay) release(events []domain.OutboxEvent) {
+	ids := make([]int64, 0, len(events))
+	for _, ev := range events {
+		ids = append(ids, ev.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.SendTimeout)
+	defer cancel()
+
+	if err := r.repo.Release(ctx, ids); err != nil {
+		// the lease runs out and the events are claimed again
+		log.WithFields(log.Fields{"service": "outbox", "count": len(ids)}).Error(err)
+		return
+	}
+
+	log.WithField("count", len(ids)).Warn("Service: outbox batch outlasted its lease, events released")
+}
+
+func (r *OutboxRelay) send(ctx context.Context, ev domain.OutboxEvent) error {
+	if ev.ActorID != nil {
+		ctx = domain.WithUserID(ctx, *ev.ActorID)
+	}
+
+	item := logger.LogItem{
+		Action:    ev.Action,
+		Entity:    ev.Entity,
+		EntityID:  ev.EntityID,
+		Timestamp: ev.CreatedAt,
+	}
+
+	var errs []error
+	for _, sink := range r.sinks {
+		if err := sink.SendLogRequest(ctx, item); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// retryDelay doubles per attempt up to the maximum.
+func (r *OutboxRelay) retryDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := r.cfg.RetryBaseDelay << (attempts - 1)
+	if delay <= 0 || delay > r.cfg.RetryMaxDelay {
+		delay = r.cfg.RetryMaxDelay
+	}
+
+	return delay
+}
+
+func (r *OutboxRelay) deleteSent() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.SendTimeout)
+	defer cancel()
+
+	n, err := r.repo.DeleteSent(ctx, time.Now().Add(-r.cfg.Retention))
+	if err != nil {
+		log.WithField("service", "outbox").Error(err)
+		return
+	}
+
+	log.WithField("deleted", n).Info("Service: outbox cleanup")
+}
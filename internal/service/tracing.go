@@ -0,0 +1,33 @@
+package service
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/jackietana/crud-app/internal/service")
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// startCacheSpan starts a span around a cache operation. The returned
+// function ends it, noting whether the lookup was a hit.
+func startCacheSpan(ctx context.Context, name string) func(hit bool) {
+	_, span := tracer.Start(ctx, name)
+
+	return func(hit bool) {
+		span.SetAttributes(attribute.Bool("cache.hit", hit))
+		span.End()
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type TrashConfig struct {
+	// Retention is how long deleted books stay in the trash.
+	Retention     time.Duration
+	PurgeInterval time.Duration
+	PurgeTimeout  time.Duration
+}
+
+// TrashPurger deletes books that have been in the trash longer than the
+// retention window. Every instance may run one: a book is deleted once,
+// whichever instance gets to it first.
+type TrashPurger struct {
+	books *BookService
+	cfg   TrashConfig
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewTrashPurger(books *BookService, cfg TrashConfig) *TrashPurger {
+	p := &TrashPurger{
+		books:   books,
+		cfg:     cfg,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go p.run()
+
+	return p
+}
+
+// Close stops the purger after the purge in progress.
+func (p *TrashPurger) Close(ctx context.Context) error {
+	p.closeOnce.Do(func() { close(p.done) })
+
+	select {
+	case <-p.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *TrashPurger) run() {
+	defer close(p.stopped)
+
+	ticker := time.NewTicker(p.cfg.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.purge()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *TrashPurger) purge() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.PurgeTimeout)
+	defer cancel()
+
+	n, err := p.books.PurgeTrash(ctx, time.Now().Add(-p.cfg.Retention))
+	if err != nil {
+		log.WithField("service", "trash").Error(err)
+		return
+	}
+
+	if n > 0 {
+		log.WithField("purged", n).Info("Service: trash purge")
+	}
+}
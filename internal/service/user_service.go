@@ -2,10 +2,11 @@ package service
 
 import (
 	"context"
-	"database/sql"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/rand"
 	"strconv"
 	"time"
 
@@ -17,39 +18,84 @@ import (
 
 type PasswordHasher interface {
 	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	NeedsRehash(encoded string) bool
 }
 
 type UserRepository interface {
 	CreateUser(ctx context.Context, user domain.User) error
-	GetByCredentials(ctx context.Context, email, password string) (domain.User, error)
+	GetByEmail(ctx context.Context, email string) (domain.User, error)
+	GetByID(ctx context.Context, id int) (domain.User, error)
+	UpdatePassword(ctx context.Context, id int, password string) error
+	UpdateRole(ctx context.Context, id int, role domain.Role) error
 }
 
 type TokenRepository interface {
+	CreateSession(ctx context.Context, session domain.Session) (int, error)
+	GetSession(ctx context.Context, id int) (domain.Session, error)
+	GetSessions(ctx context.Context, userId int) ([]domain.Session, error)
+	TouchSession(ctx context.Context, id int, meta domain.SessionMeta) error
+	RevokeSession(ctx context.Context, userId, id int) error
+	RevokeSessions(ctx context.Context, userId int) ([]int, error)
 	Create(ctx context.Context, token domain.RefreshToken) error
-	Get(ctx context.Context, token string) (domain.RefreshToken, error)
+	Get(ctx context.Context, tokenHash string) (domain.RefreshToken, error)
+	MarkUsed(ctx context.Context, id int) (bool, error)
 }
 
-type LoggerClient interface {
-	SendLogRequest(ctx context.Context, req logger.LogItem) error
+// TokenDenylist holds revoked access token ids and sessions until the
+// tokens issued for them expire.
+type TokenDenylist interface {
+	Add(ctx context.Context, key string, expiresAt time.Time) error
+	Contains(ctx context.Context, key string) (bool, error)
+}
+
+type UserMetrics interface {
+	SignIn(success bool)
+	LoggerSendFailure()
+}
+
+type tokenClaims struct {
+	jwt.StandardClaims
+	Role      domain.Role `json:"role"`
+	SessionID int         `json:"sid,omitempty"`
 }
 
 type UserService struct {
-	userRepo     UserRepository
-	tokenRepo    TokenRepository
-	hasher       PasswordHasher
-	loggerClient LoggerClient
+	userRepo  UserRepository
+	tokenRepo TokenRepository
+	denylist  TokenDenylist
+	hasher    PasswordHasher
+	auditor   auditor
+	metrics   UserMetrics
 
 	hmacSecret []byte
 	tokenTTL   time.Duration
 	refreshTTL time.Duration
+
+	// dummyHash is verified against when the email is unknown, so signing
+	// in takes as long as for a wrong password and does not tell which
+	// emails are registered
+	dummyHash string
 }
 
-func NewUserService(userRepo UserRepository, tokenRepo TokenRepository, hasher PasswordHasher,
-	logger LoggerClient, secret []byte, tokenTTL time.Duration, refreshTTL time.Duration) *UserService {
-	return &UserService{userRepo, tokenRepo, hasher, logger, secret, tokenTTL, refreshTTL}
+func NewUserService(userRepo UserRepository, tokenRepo TokenRepository, denylist TokenDenylist,
+	hasher PasswordHasher, logger LoggerClient, metrics UserMetrics, secret []byte, tokenTTL time.Duration,
+	refreshTTL time.Duration) *UserService {
+	// made with the configured parameters, so it costs as much to verify
+	// as a current stored hash
+	dummyHash, err := hasher.Hash("dummy password")
+	if err != nil {
+		log.WithField("service", "NewUserService").Error(err)
+	}
+
+	return &UserService{userRepo, tokenRepo, denylist, hasher, auditor{logger, metrics}, metrics, secret, tokenTTL,
+		refreshTTL, dummyHash}
 }
 
-func (us *UserService) SignUp(ctx context.Context, input domain.User) error {
+func (us *UserService) SignUp(ctx context.Context, input domain.User) (err error) {
+	ctx, span := tracer.Start(ctx, "UserService.SignUp")
+	defer func() { endSpan(span, err) }()
+
 	password, err := us.hasher.Hash(input.Password)
 	if err != nil {
 		return err
@@ -62,47 +108,84 @@ func (us *UserService) SignUp(ctx context.Context, input domain.User) error {
 		RegisteredAt: time.Now(),
 	}
 
-	if err := us.userRepo.CreateUser(ctx, user); err != nil {
-		return err
+	return us.userRepo.CreateUser(ctx, user)
+}
+
+func (us *UserService) SignIn(ctx context.Context, input domain.UserSignIn, meta domain.SessionMeta) (accessToken, refreshToken string, err error) {
+	ctx, span := tracer.Start(ctx, "UserService.SignIn")
+	defer func() { endSpan(span, err) }()
+
+	accessToken, refreshToken, err = us.signIn(ctx, input, meta)
+	us.metrics.SignIn(err == nil)
+
+	return accessToken, refreshToken, err
+}
+
+func (us *UserService) signIn(ctx context.Context, input domain.UserSignIn, meta domain.SessionMeta) (string, string, error) {
+	user, err := us.userRepo.GetByEmail(ctx, input.Email)
+	if err != nil {
+		if errors.Is(err, domain.ErrUserNotFound) {
+			us.hasher.Verify(input.Password, us.dummyHash)
+			return "", "", domain.ErrUserNotFound
+		}
+
+		return "", "", err
 	}
 
-	user, err = us.userRepo.GetByCredentials(ctx, input.Email, password)
+	ok, err := us.hasher.Verify(input.Password, user.Password)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	if err := us.loggerClient.SendLogRequest(ctx, logger.LogItem{
-		Action:    logger.ACTION_REGISTER,
-		Entity:    logger.ENTITY_USER,
-		EntityID:  int64(user.ID),
-		Timestamp: time.Now(),
-	}); err != nil {
-		log.WithField("service", "User.signUp").Error(err)
+	if !ok {
+		return "", "", domain.ErrUserNotFound
 	}
 
-	return nil
-}
+	if us.hasher.NeedsRehash(user.Password) {
+		us.rehashPassword(ctx, user.ID, input.Password)
+	}
 
-func (us *UserService) SignIn(ctx context.Context, input domain.UserSignIn) (string, string, error) {
-	password, err := us.hasher.Hash(input.Password)
+	sessionId, err := us.tokenRepo.CreateSession(ctx, domain.Session{
+		UserID:    user.ID,
+		UserAgent: meta.UserAgent,
+		IP:        meta.IP,
+	})
 	if err != nil {
 		return "", "", err
 	}
 
-	user, err := us.userRepo.GetByCredentials(ctx, input.Email, password)
+	accessToken, refreshToken, err := us.generateTokens(ctx, user, sessionId)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return "", "", domain.ErrUserNotFound
-		}
-
 		return "", "", err
 	}
 
-	return us.generateTokens(ctx, user.ID)
+	us.auditor.send(ctx, logger.ACTION_LOGIN, logger.ENTITY_USER, user.ID)
+
+	return accessToken, refreshToken, nil
 }
 
-func (us *UserService) ParseToken(ctx context.Context, token string) (int, error) {
-	t, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+// rehashPassword upgrades a stored hash to the current scheme. Failing to
+// do so must not fail the sign in, the upgrade is retried next time.
+func (us *UserService) rehashPassword(ctx context.Context, userId int, password string) {
+	hash, err := us.hasher.Hash(password)
+	if err == nil {
+		err = us.userRepo.UpdatePassword(ctx, userId, hash)
+	}
+
+	if err != nil {
+		log.WithField("service", "User.rehashPassword").Error(err)
+		return
+	}
+
+	log.WithField("id", userId).Info("Service: password hash upgraded")
+}
+
+func (us *UserService) ParseToken(ctx context.Context, token string) (_ domain.TokenClaims, err error) {
+	ctx, span := tracer.Start(ctx, "UserService.ParseToken")
+	defer func() { endSpan(span, err) }()
+
+	var claims tokenClaims
+	t, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
@@ -110,49 +193,236 @@ func (us *UserService) ParseToken(ctx context.Context, token string) (int, error
 		return us.hmacSecret, nil
 	})
 	if err != nil {
-		return 0, err
+		return domain.TokenClaims{}, err
 	}
 
 	if !t.Valid {
-		return 0, errors.New("invalid token")
+		return domain.TokenClaims{}, errors.New("invalid token")
 	}
 
-	claims, ok := t.Claims.(jwt.MapClaims)
-	if !ok {
-		return 0, errors.New("invalid claims")
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return domain.TokenClaims{}, errors.New("invalid subject")
 	}
 
-	subject, ok := claims["sub"].(string)
-	if !ok {
-		return 0, errors.New("invalid subject")
+	// tokens issued before roles were introduced carry no role
+	role := claims.Role
+	if role == "" {
+		role = domain.RoleReader
+	}
+
+	if !role.Valid() {
+		return domain.TokenClaims{}, domain.ErrInvalidRole
+	}
+
+	if err := us.checkRevoked(ctx, claims); err != nil {
+		return domain.TokenClaims{}, err
+	}
+
+	return domain.TokenClaims{
+		ID:        claims.Id,
+		UserID:    id,
+		Role:      role,
+		SessionID: claims.SessionID,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, nil
+}
+
+func (us *UserService) checkRevoked(ctx context.Context, claims tokenClaims) error {
+	keys := make([]string, 0, 2)
+	if claims.Id != "" {
+		keys = append(keys, tokenDenyKey(claims.Id))
+	}
+	if claims.SessionID != 0 {
+		keys = append(keys, sessionDenyKey(claims.SessionID))
 	}
 
-	id, err := strconv.Atoi(subject)
+	for _, key := range keys {
+		revoked, err := us.denylist.Contains(ctx, key)
+		if err != nil {
+			// the token may well be valid, this is not an auth failure
+			return fmt.Errorf("%w: %v", domain.ErrTokenCheckFailed, err)
+		}
+
+		if revoked {
+			return domain.ErrTokenRevoked
+		}
+	}
+
+	return nil
+}
+
+// Logout ends the session the access token was issued for and revokes the token itself.
+func (us *UserService) Logout(ctx context.Context, claims domain.TokenClaims) (err error) {
+	ctx, span := tracer.Start(ctx, "UserService.Logout")
+	defer func() { endSpan(span, err) }()
+
+	if claims.SessionID != 0 {
+		if err := us.RevokeSession(ctx, claims.UserID, claims.SessionID); err != nil &&
+			!errors.Is(err, domain.ErrSessionNotFound) {
+			return err
+		}
+	}
+
+	if claims.ID == "" {
+		return nil
+	}
+
+	return us.denylist.Add(ctx, tokenDenyKey(claims.ID), claims.ExpiresAt)
+}
+
+// LogoutAll ends every session of the user, on all devices.
+func (us *UserService) LogoutAll(ctx context.Context, claims domain.TokenClaims) (err error) {
+	ctx, span := tracer.Start(ctx, "UserService.LogoutAll")
+	defer func() { endSpan(span, err) }()
+
+	ids, err := us.tokenRepo.RevokeSessions(ctx, claims.UserID)
 	if err != nil {
-		return 0, errors.New("invalid subject")
+		return err
 	}
 
-	return id, nil
+	for _, id := range ids {
+		if err := us.denylist.Add(ctx, sessionDenyKey(id), time.Now().Add(us.tokenTTL)); err != nil {
+			return err
+		}
+	}
+
+	if claims.ID == "" {
+		return nil
+	}
+
+	return us.denylist.Add(ctx, tokenDenyKey(claims.ID), claims.ExpiresAt)
+}
+
+func (us *UserService) SetRole(ctx context.Context, userId int, role domain.Role) (err error) {
+	ctx, span := tracer.Start(ctx, "UserService.SetRole")
+	defer func() { endSpan(span, err) }()
+
+	if !role.Valid() {
+		return domain.ErrInvalidRole
+	}
+
+	return us.userRepo.UpdateRole(ctx, userId, role)
 }
 
-func (us *UserService) RefreshTokens(ctx context.Context, strRefreshToken string) (string, string, error) {
-	refreshToken, err := us.tokenRepo.Get(ctx, strRefreshToken)
+// RefreshTokens rotates the refresh token of a session. Presenting a token
+// that was already rotated means it leaked, so the whole session is revoked.
+func (us *UserService) RefreshTokens(ctx context.Context, strRefreshToken string, meta domain.SessionMeta) (_, _ string, err error) {
+	ctx, span := tracer.Start(ctx, "UserService.RefreshTokens")
+	defer func() { endSpan(span, err) }()
+
+	refreshToken, err := us.tokenRepo.Get(ctx, hashRefreshToken(strRefreshToken))
+	if err != nil {
+		return "", "", err
+	}
+
+	session, err := us.tokenRepo.GetSession(ctx, refreshToken.SessionID)
 	if err != nil {
 		return "", "", err
 	}
 
+	if session.RevokedAt != nil {
+		return "", "", domain.ErrSessionRevoked
+	}
+
+	if refreshToken.UsedAt != nil {
+		return "", "", us.revokeReusedSession(ctx, session)
+	}
+
 	if refreshToken.ExpiresAt.Unix() < time.Now().Unix() {
 		return "", "", domain.ErrRefreshTokenExpired
 	}
 
-	return us.generateTokens(ctx, refreshToken.UserID)
+	rotated, err := us.tokenRepo.MarkUsed(ctx, refreshToken.ID)
+	if err != nil {
+		return "", "", err
+	}
+
+	if !rotated {
+		return "", "", us.revokeReusedSession(ctx, session)
+	}
+
+	if err := us.tokenRepo.TouchSession(ctx, session.ID, meta); err != nil {
+		return "", "", err
+	}
+
+	user, err := us.userRepo.GetByID(ctx, refreshToken.UserID)
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, rotatedToken, err := us.generateTokens(ctx, user, session.ID)
+	if err != nil {
+		return "", "", err
+	}
+
+	// the logger has no refresh action, a refresh re-authenticates the session
+	us.auditor.send(ctx, logger.ACTION_LOGIN, logger.ENTITY_USER, user.ID)
+
+	return accessToken, rotatedToken, nil
 }
 
-func (us *UserService) generateTokens(ctx context.Context, userId int) (string, string, error) {
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
-		Subject:   strconv.Itoa(int(userId)),
-		IssuedAt:  time.Now().Unix(),
-		ExpiresAt: time.Now().Add(us.tokenTTL).Unix(),
+func (us *UserService) revokeReusedSession(ctx context.Context, session domain.Session) error {
+	log.WithFields(log.Fields{
+		"service": "User.RefreshTokens",
+		"session": session.ID,
+		"user":    session.UserID,
+	}).Warn("refresh token reuse detected, revoking session")
+
+	if err := us.RevokeSession(ctx, session.UserID, session.ID); err != nil &&
+		!errors.Is(err, domain.ErrSessionNotFound) {
+		return err
+	}
+
+	return domain.ErrRefreshTokenReused
+}
+
+// GetSessions returns the active sessions of a user, flagging the one the
+// request was made from.
+func (us *UserService) GetSessions(ctx context.Context, userId, currentSessionId int) (_ []domain.Session, err error) {
+	ctx, span := tracer.Start(ctx, "UserService.GetSessions")
+	defer func() { endSpan(span, err) }()
+
+	sessions, err := us.tokenRepo.GetSessions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionId
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession revokes the refresh tokens of a session and, through the
+// denylist, the access tokens issued for it.
+func (us *UserService) RevokeSession(ctx context.Context, userId, sessionId int) (err error) {
+	ctx, span := tracer.Start(ctx, "UserService.RevokeSession")
+	defer func() { endSpan(span, err) }()
+
+	if err := us.tokenRepo.RevokeSession(ctx, userId, sessionId); err != nil {
+		return err
+	}
+
+	return us.denylist.Add(ctx, sessionDenyKey(sessionId), time.Now().Add(us.tokenTTL))
+}
+
+func (us *UserService) generateTokens(ctx context.Context, user domain.User, sessionId int) (string, string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(us.tokenTTL).Unix(),
+		},
+		Role:      user.Role,
+		SessionID: sessionId,
 	})
 
 	accessToken, err := t.SignedString(us.hmacSecret)
@@ -166,8 +436,9 @@ func (us *UserService) generateTokens(ctx context.Context, userId int) (string,
 	}
 
 	if err := us.tokenRepo.Create(ctx, domain.RefreshToken{
-		UserID:    userId,
-		Token:     refreshToken,
+		SessionID: sessionId,
+		UserID:    user.ID,
+		TokenHash: hashRefreshToken(refreshToken),
 		ExpiresAt: time.Now().Add(us.refreshTTL),
 	}); err != nil {
 		return "", "", err
@@ -179,12 +450,35 @@ func (us *UserService) generateTokens(ctx context.Context, userId int) (string,
 func newRefreshToken() (string, error) {
 	b := make([]byte, 32)
 
-	s := rand.NewSource(time.Now().Unix())
-	r := rand.New(s)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
 
-	if _, err := r.Read(b); err != nil {
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("%x", b), nil
+	return hex.EncodeToString(b), nil
+}
+
+func tokenDenyKey(jti string) string {
+	return "jti:" + jti
+}
+
+func sessionDenyKey(sessionId int) string {
+	return "sid:" + strconv.Itoa(sessionId)
+}
+
+// hashRefreshToken hashes a refresh token for storage. Tokens are random
+// 256 bit values, so a plain SHA-256 is enough to keep them from leaking.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
 }
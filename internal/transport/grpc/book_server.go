@@ -0,0 +1,281 @@
+package grpc_client
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	"github.com/jackietana/crud-app/pkg/api/bookpb"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var errVersionRequired = errors.New("version is required")
+
+type bookServer struct {
+	bookpb.UnimplementedBookServiceServer
+
+	books    BookService
+	stopping <-chan struct{}
+	// requireVersion rejects writes without a version, like REST does
+	// without If-Match when server.require_if_match is set
+	requireVersion bool
+}
+
+func (s *bookServer) GetBook(ctx context.Context, req *bookpb.GetBookRequest) (*bookpb.Book, error) {
+	book, err := s.books.GetBookById(ctx, int(req.GetId()))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "GetBook",
+			"issue":   "service error",
+		}).Error(err)
+		return nil, toStatus(err)
+	}
+
+	log.WithField("id", book.ID).Info("gRPC: GetBook")
+
+	return toPbBook(book), nil
+}
+
+func (s *bookServer) ListBooks(ctx context.Context, req *bookpb.ListBooksRequest) (*bookpb.ListBooksResponse, error) {
+	q := domain.BookQuery{
+		Limit:       int(req.GetLimit()),
+		Offset:      int(req.GetOffset()),
+		Cursor:      req.GetCursor(),
+		Author:      req.GetAuthor(),
+		Genres:      req.GetGenres(),
+		GenresMatch: req.GetGenresMatch(),
+		SortBy:      req.GetSortBy(),
+		SortOrder:   req.GetSortOrder(),
+	}
+
+	if req.IsFree != nil {
+		isFree := req.GetIsFree().GetValue()
+		q.IsFree = &isFree
+	}
+
+	if req.PublishedFrom != nil {
+		from := req.GetPublishedFrom().AsTime()
+		q.PublishedFrom = &from
+	}
+
+	if req.PublishedTo != nil {
+		to := req.GetPublishedTo().AsTime()
+		q.PublishedTo = &to
+	}
+
+	page, err := s.books.GetBooks(ctx, q)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "ListBooks",
+			"issue":   "service error",
+		}).Error(err)
+		return nil, toStatus(err)
+	}
+
+	resp := &bookpb.ListBooksResponse{
+		Books:      make([]*bookpb.Book, 0, len(page.Books)),
+		Total:      int64(page.Total),
+		Limit:      int32(page.Limit),
+		Offset:     int32(page.Offset),
+		NextCursor: page.NextCursor,
+	}
+
+	for _, book := range page.Books {
+		resp.Books = append(resp.Books, toPbBook(book))
+	}
+
+	log.WithField("count", len(resp.Books)).Info("gRPC: ListBooks")
+
+	return resp, nil
+}
+
+func (s *bookServer) CreateBook(ctx context.Context, req *bookpb.CreateBookRequest) (*bookpb.Book, error) {
+	book, err := fromPbBook(req.GetBook())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	created, err := s.books.CreateBook(ctx, book)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "CreateBook",
+			"issue":   "service error",
+		}).Error(err)
+		return nil, toStatus(err)
+	}
+
+	log.WithField("id", created.ID).Info("gRPC: CreateBook")
+
+	return toPbBook(created), nil
+}
+
+func (s *bookServer) UpdateBook(ctx context.Context, req *bookpb.UpdateBookRequest) (*emptypb.Empty, error) {
+	book, err := fromPbBook(req.GetBook())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	version, err := s.writeVersion(req.GetBook().GetVersion())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	if _, err := s.books.UpdateBook(ctx, int(req.GetId()), book, version); err != nil {
+		log.WithFields(log.Fields{
+			"handler": "UpdateBook",
+			"issue":   "service error",
+		}).Error(err)
+		return nil, toStatus(err)
+	}
+
+	log.WithField("id", req.GetId()).Info("gRPC: UpdateBook")
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *bookServer) DeleteBook(ctx context.Context, req *bookpb.DeleteBookRequest) (*emptypb.Empty, error) {
+	version, err := s.writeVersion(req.GetVersion())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	if err := s.books.DeleteBook(ctx, int(req.GetId()), version); err != nil {
+		log.WithFields(log.Fields{
+			"handler": "DeleteBook",
+			"issue":   "service error",
+		}).Error(err)
+		return nil, toStatus(err)
+	}
+
+	log.WithField("id", req.GetId()).Info("gRPC: DeleteBook")
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *bookServer) WatchBooks(req *bookpb.WatchBooksRequest, stream grpc.ServerStreamingServer[bookpb.BookEvent]) error {
+	ctx := stream.Context()
+
+	ids := make(map[int64]bool, len(req.GetIds()))
+	for _, id := range req.GetIds() {
+		ids[id] = true
+	}
+
+	events := s.books.WatchBooks(ctx)
+
+	log.WithField("ids", req.GetIds()).Info("gRPC: WatchBooks")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.stopping:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case ev, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+
+				return status.Error(codes.ResourceExhausted, "watcher fell behind, events were dropped")
+			}
+
+			if len(ids) > 0 && !ids[int64(ev.ID)] {
+				continue
+			}
+
+			if err := stream.Send(toPbBookEvent(ev)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeVersion returns the book version a write requires, 0 when any
+// version will do, as ifMatchVersion does for REST.
+func (s *bookServer) writeVersion(version int32) (int, error) {
+	switch {
+	case version < 0:
+		return 0, domain.ErrVersionMismatch
+	case version == 0 && s.requireVersion:
+		return 0, errVersionRequired
+	}
+
+	return int(version), nil
+}
+
+// toStatus maps service errors to gRPC codes the way the REST handlers
+// map them to HTTP statuses.
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, domain.ErrBookNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, domain.ErrInvalidBookQuery), errors.Is(err, domain.ErrInvalidCursor),
+		errors.Is(err, domain.ErrInvalidBook):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, domain.ErrVersionMismatch):
+		return status.Error(codes.Aborted, "book was changed: version does not match")
+	case errors.Is(err, errVersionRequired):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func toPbBook(book domain.Book) *bookpb.Book {
+	return &bookpb.Book{
+		Id:          int64(book.ID),
+		Name:        book.Name,
+		Description: book.Description,
+		Author:      book.Author,
+		IsFree:      book.IsFree,
+		Genres:      book.Genres,
+		PublishedAt: timestamppb.New(book.PublishedAt),
+		Version:     int32(book.Version),
+	}
+}
+
+// fromPbBook checks the fields REST requires when binding a book.
+func fromPbBook(book *bookpb.Book) (domain.Book, error) {
+	if book == nil {
+		return domain.Book{}, errors.New("book is required")
+	}
+
+	if book.GetName() == "" || book.GetDescription() == "" || book.GetAuthor() == "" || len(book.GetGenres()) == 0 {
+		return domain.Book{}, errors.New("name, description, author and genres are required")
+	}
+
+	return domain.Book{
+		Name:        book.GetName(),
+		Description: book.GetDescription(),
+		Author:      book.GetAuthor(),
+		IsFree:      book.GetIsFree(),
+		Genres:      book.GetGenres(),
+	}, nil
+}
+
+func toPbBookEvent(ev domain.BookEvent) *bookpb.BookEvent {
+	pbEvent := &bookpb.BookEvent{
+		Id:        int64(ev.ID),
+		Timestamp: timestamppb.New(ev.Timestamp),
+	}
+
+	switch ev.Type {
+	case domain.BookCreated:
+		pbEvent.Type = bookpb.BookEvent_CREATED
+	case domain.BookUpdated:
+		pbEvent.Type = bookpb.BookEvent_UPDATED
+	case domain.BookDeleted:
+		pbEvent.Type = bookpb.BookEvent_DELETED
+	}
+
+	if ev.Book != nil {
+		pbEvent.Book = toPbBook(*ev.Book)
+	}
+
+	return pbEvent
+}
@@ -0,0 +1,60 @@
+package grpc_client
+
+import "time"
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker stops calls to the logger after too many consecutive failures.
+// Once the cooldown passes a single probe call is let through: success
+// closes the breaker, failure opens it again. It is used only by the
+// dispatcher goroutine and is not safe for concurrent use.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *breaker) allow() bool {
+	if b.state == breakerOpen {
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+
+		b.state = breakerHalfOpen
+	}
+
+	return true
+}
+
+func (b *breaker) success() {
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+func (b *breaker) failure() {
+	b.failures++
+
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// open reports whether calls are currently refused, that is the breaker
+// is open and still cooling down.
+func (b *breaker) open() bool {
+	return b.state == breakerOpen && time.Since(b.openedAt) < b.cooldown
+}
@@ -2,24 +2,92 @@ package grpc_client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/jackietana/crud-app/internal/domain"
 	logger "github.com/jackietana/grpc-logger/pkg/domain"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+const (
+	actorMetadataKey = "x-actor-id"
+	authMetadataKey  = "authorization"
+)
+
+type Config struct {
+	Address string
+	// Timeout is the deadline of a single log call, none when zero.
+	Timeout time.Duration
+	// Token is sent as a bearer token with every call.
+	Token string
+
+	TLS       TLSConfig
+	Keepalive KeepaliveConfig
+}
+
+// TLSConfig secures the connection. With CertFile and KeyFile the client
+// also authenticates itself (mTLS). An empty CAFile uses the system roots.
+type TLSConfig struct {
+	Enabled    bool
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+}
+
+// KeepaliveConfig pings the logger on an idle connection, no pings when Time is zero.
+type KeepaliveConfig struct {
+	Time                time.Duration
+	Timeout             time.Duration
+	PermitWithoutStream bool
+}
+
 type Client struct {
 	conn         *grpc.ClientConn
 	loggerClient logger.LoggerServiceClient
+
+	timeout time.Duration
+	token   string
 }
 
-func NewClient(port int) (*Client, error) {
-	var conn *grpc.ClientConn
+func NewClient(cfg Config) (*Client, error) {
+	creds := insecure.NewCredentials()
+	if cfg.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
 
-	addr := fmt.Sprintf(":%d", port)
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	}
+
+	if cfg.Keepalive.Time > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                cfg.Keepalive.Time,
+			Timeout:             cfg.Keepalive.Timeout,
+			PermitWithoutStream: cfg.Keepalive.PermitWithoutStream,
+		}))
+	}
 
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	conn, err := grpc.NewClient(cfg.Address, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -27,9 +95,70 @@ func NewClient(port int) (*Client, error) {
 	return &Client{
 		conn:         conn,
 		loggerClient: logger.NewLoggerServiceClient(conn),
+		timeout:      cfg.Timeout,
+		token:        cfg.Token,
 	}, nil
 }
 
+func newTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: cfg.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("client certificate needs both cert and key files")
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Check reports an error unless the connection to the logger is usable.
+// An idle connection is asked to connect and counts as healthy only once
+// it does, before ctx is done.
+func (c *Client) Check(ctx context.Context) error {
+	for {
+		state := c.conn.GetState()
+
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Idle:
+			c.conn.Connect()
+		case connectivity.Connecting:
+		default:
+			return fmt.Errorf("logger connection is %s", state)
+		}
+
+		if !c.conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("logger connection is %s: %w", c.conn.GetState(), ctx.Err())
+		}
+	}
+}
+
 func (c *Client) CloseConnection() error {
 	return c.conn.Close()
 }
@@ -45,6 +174,21 @@ func (c *Client) SendLogRequest(ctx context.Context, req logger.LogItem) error {
 		return err
 	}
 
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	if c.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, authMetadataKey, "Bearer "+c.token)
+	}
+
+	// the log request has no actor field, the acting user travels as metadata
+	if userId, ok := domain.UserIDFromContext(ctx); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, actorMetadataKey, strconv.Itoa(userId))
+	}
+
 	_, err = c.loggerClient.Log(ctx, &logger.LogRequest{
 		Action:    action,
 		Entity:    entity,
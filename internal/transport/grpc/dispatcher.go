@@ -0,0 +1,289 @@
+package grpc_client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	logger "github.com/jackietana/grpc-logger/pkg/domain"
+	log "github.com/sirupsen/logrus"
+)
+
+var errBreakerOpen = errors.New("logger circuit breaker is open")
+
+type Sender interface {
+	SendLogRequest(ctx context.Context, req logger.LogItem) error
+}
+
+type DispatcherMetrics interface {
+	LoggerSendFailure()
+}
+
+type DispatcherConfig struct {
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	SendTimeout   time.Duration
+
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// SpoolFile keeps events the logger could not take. Without it such
+	// events are dropped.
+	SpoolFile string
+}
+
+// event is an audit item along with the acting user, which is taken from
+// the request context when the item is queued.
+type event struct {
+	Item    logger.LogItem `json:"item"`
+	ActorID *int           `json:"actor_id,omitempty"`
+}
+
+// Dispatcher sends audit events to the logger in the background, so
+// requests never wait for it. Events are queued, sent in batches with
+// retries, and spooled to disk while the logger is unreachable, to be
+// replayed once it recovers.
+type Dispatcher struct {
+	sender  Sender
+	cfg     DispatcherConfig
+	metrics DispatcherMetrics
+
+	queue   chan event
+	spool   *spool
+	breaker *breaker
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewDispatcher(sender Sender, cfg DispatcherConfig, metrics DispatcherMetrics) (*Dispatcher, error) {
+	d := &Dispatcher{
+		sender:  sender,
+		cfg:     cfg,
+		metrics: metrics,
+		queue:   make(chan event, cfg.QueueSize),
+		breaker: newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	if cfg.SpoolFile != "" {
+		s, err := openSpool(cfg.SpoolFile)
+		if err != nil {
+			return nil, err
+		}
+
+		d.spool = s
+	}
+
+	go d.run()
+
+	return d, nil
+}
+
+// SendLogRequest queues the event and returns at once. When the queue is
+// full the event goes straight to the spool.
+func (d *Dispatcher) SendLogRequest(ctx context.Context, req logger.LogItem) error {
+	ev := event{Item: req}
+	if userId, ok := domain.UserIDFromContext(ctx); ok {
+		ev.ActorID = &userId
+	}
+
+	select {
+	case <-d.done:
+		return d.spill(ev)
+	default:
+	}
+
+	select {
+	case d.queue <- ev:
+		return nil
+	default:
+		return d.spill(ev)
+	}
+}
+
+// Close stops the dispatcher. Queued events are sent if the logger is
+// reachable and spooled otherwise.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.closeOnce.Do(func() { close(d.done) })
+
+	select {
+	case <-d.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if d.spool != nil {
+		return d.spool.close()
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.stopped)
+
+	ticker := time.NewTicker(d.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]event, 0, d.cfg.BatchSize)
+
+	for {
+		select {
+		case ev := <-d.queue:
+			batch = append(batch, ev)
+			if len(batch) >= d.cfg.BatchSize {
+				d.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			d.flush(batch)
+			batch = batch[:0]
+		case <-d.done:
+		drain:
+			for {
+				select {
+				case ev := <-d.queue:
+					batch = append(batch, ev)
+				default:
+					break drain
+				}
+			}
+
+			d.flush(batch)
+			return
+		}
+	}
+}
+
+// flush sends the batch after the spooled events, which are older. While
+// some are left in the spool the batch is spooled behind them.
+func (d *Dispatcher) flush(batch []event) {
+	d.replay()
+	if d.spool != nil && d.spool.pending() {
+		d.spill(batch...)
+		return
+	}
+
+	for i, ev := range batch {
+		if err := d.deliver(ev); err != nil {
+			if errors.Is(err, errBreakerOpen) {
+				d.spill(batch[i:]...)
+				return
+			}
+
+			d.spill(ev)
+		}
+	}
+}
+
+// deliver sends an event, retrying with exponential backoff. Retries
+// are skipped once the dispatcher is stopping.
+func (d *Dispatcher) deliver(ev event) error {
+	var err error
+
+	for attempt := 0; attempt <= d.cfg.MaxRetries; attempt++ {
+		if !d.breaker.allow() {
+			return errBreakerOpen
+		}
+
+		if attempt > 0 {
+			select {
+			case <-time.After(d.backoff(attempt)):
+			case <-d.done:
+				if err == nil {
+					err = errors.New("dispatcher stopped")
+				}
+				return err
+			}
+		}
+
+		if err = d.send(ev); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (d *Dispatcher) send(ev event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.SendTimeout)
+	defer cancel()
+
+	if ev.ActorID != nil {
+		ctx = domain.WithUserID(ctx, *ev.ActorID)
+	}
+
+	if err := d.sender.SendLogRequest(ctx, ev.Item); err != nil {
+		d.breaker.failure()
+		d.metrics.LoggerSendFailure()
+		log.WithFields(log.Fields{
+			"dispatcher": "send",
+			"action":     ev.Item.Action,
+			"entity":     ev.Item.Entity,
+			"entity_id":  ev.Item.EntityID,
+		}).Error(err)
+
+		return err
+	}
+
+	d.breaker.success()
+
+	return nil
+}
+
+// backoff returns the delay before a retry, doubling per attempt up to
+// the maximum, with jitter so replicas do not retry in lockstep.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.cfg.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > d.cfg.RetryMaxDelay {
+		delay = d.cfg.RetryMaxDelay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// replay sends spooled events once the logger takes events again.
+func (d *Dispatcher) replay() {
+	if d.spool == nil || d.breaker.open() || !d.spool.pending() {
+		return
+	}
+
+	if err := d.spool.replay(func(ev event) error {
+		if !d.breaker.allow() {
+			return errBreakerOpen
+		}
+
+		return d.send(ev)
+	}); err != nil {
+		log.WithField("dispatcher", "replay").Error(err)
+	}
+}
+
+func (d *Dispatcher) spill(events ...event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	if d.spool == nil {
+		log.WithField("dispatcher", "spill").Errorf("no spool configured, dropping %d audit events", len(events))
+		return errors.New("audit events dropped")
+	}
+
+	if err := d.spool.append(events...); err != nil {
+		log.WithField("dispatcher", "spill").Error(err)
+		return err
+	}
+
+	return nil
+}
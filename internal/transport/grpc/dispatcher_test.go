@@ -0,0 +1,350 @@
+package grpc_client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	logger "github.com/jackietana/grpc-logger/pkg/domain"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) LoggerSendFailure() {}
+
+var errSendFailed = errors.New("logger unavailable")
+
+// fakeSender records the events it takes. It fails while down is set and
+// for the first failFirst calls.
+type fakeSender struct {
+	mu        sync.Mutex
+	down      bool
+	failFirst int
+	calls     int
+	sent      []int64
+}
+
+func (s *fakeSender) SendLogRequest(_ context.Context, req logger.LogItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.down || s.calls <= s.failFirst {
+		return errSendFailed
+	}
+
+	s.sent = append(s.sent, req.EntityID)
+
+	return nil
+}
+
+func (s *fakeSender) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *fakeSender) stats() (int, []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls, append([]int64(nil), s.sent...)
+}
+
+func testConfig(t *testing.T) DispatcherConfig {
+	return DispatcherConfig{
+		QueueSize:        16,
+		BatchSize:        100,
+		FlushInterval:    time.Hour,
+		SendTimeout:      time.Second,
+		RetryBaseDelay:   time.Millisecond,
+		RetryMaxDelay:    time.Millisecond,
+		BreakerThreshold: 100,
+		BreakerCooldown:  time.Hour,
+		SpoolFile:        filepath.Join(t.TempDir(), "audit.spool"),
+	}
+}
+
+// newTestDispatcher starts a dispatcher whose run loop stays idle: nothing
+// is queued and the flush interval is long, so tests can call flush and
+// deliver themselves.
+func newTestDispatcher(t *testing.T, sender Sender, cfg DispatcherConfig) *Dispatcher {
+	t.Helper()
+
+	d, err := NewDispatcher(sender, cfg, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close(context.Background()) })
+
+	return d
+}
+
+func testEvents(ids ...int64) []event {
+	events := make([]event, len(ids))
+	for i, id := range ids {
+		events[i] = event{Item: logger.LogItem{Entity: logger.ENTITY_BOOK, Action: logger.ACTION_CREATE, EntityID: id}}
+	}
+
+	return events
+}
+
+// spooledIDs lists the entity ids of the spooled events, in order.
+func spooledIDs(t *testing.T, path string) []int64 {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var ids []int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, ev.Item.EntityID)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ids
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		failFirst  int
+		wantCalls  int
+		wantErr    bool
+	}{
+		{
+			name:       "no retries",
+			maxRetries: 0,
+			failFirst:  1,
+			wantCalls:  1,
+			wantErr:    true,
+		},
+		{
+			name:       "delivered on a retry",
+			maxRetries: 3,
+			failFirst:  2,
+			wantCalls:  3,
+		},
+		{
+			name:       "gives up after MaxRetries",
+			maxRetries: 2,
+			failFirst:  10,
+			wantCalls:  3,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{failFirst: tt.failFirst}
+			cfg := testConfig(t)
+			cfg.MaxRetries = tt.maxRetries
+			d := newTestDispatcher(t, sender, cfg)
+
+			err := d.deliver(testEvents(1)[0])
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deliver returned %v, want error %v", err, tt.wantErr)
+			}
+
+			if calls, _ := sender.stats(); calls != tt.wantCalls {
+				t.Errorf("%d send attempts, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDispatcherBreaker(t *testing.T) {
+	const (
+		threshold = 3
+		cooldown  = 50 * time.Millisecond
+	)
+
+	tests := []struct {
+		name      string
+		probeDown bool
+		// wantOpen is whether the breaker refuses calls after the probe
+		wantOpen bool
+	}{
+		{
+			name: "probe success closes",
+		},
+		{
+			name:      "probe failure opens again",
+			probeDown: true,
+			wantOpen:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{down: true}
+			cfg := testConfig(t)
+			cfg.BreakerThreshold = threshold
+			cfg.BreakerCooldown = cooldown
+			d := newTestDispatcher(t, sender, cfg)
+			ev := testEvents(1)[0]
+
+			for i := 0; i < threshold; i++ {
+				if err := d.deliver(ev); !errors.Is(err, errSendFailed) {
+					t.Fatalf("deliver %d returned %v, want the send error", i, err)
+				}
+			}
+
+			if err := d.deliver(ev); !errors.Is(err, errBreakerOpen) {
+				t.Fatalf("deliver after %d failures returned %v, want errBreakerOpen", threshold, err)
+			}
+			if calls, _ := sender.stats(); calls != threshold {
+				t.Fatalf("%d send attempts, the open breaker let one through", calls)
+			}
+
+			time.Sleep(cooldown)
+			sender.setDown(tt.probeDown)
+
+			// half open: a single probe goes through
+			d.deliver(ev)
+			if calls, _ := sender.stats(); calls != threshold+1 {
+				t.Fatalf("%d send attempts after the cooldown, want one probe", calls-threshold)
+			}
+
+			if open := d.breaker.open(); open != tt.wantOpen {
+				t.Errorf("breaker open is %v after the probe, want %v", open, tt.wantOpen)
+			}
+		})
+	}
+}
+
+// TestDispatcherReplayOrder checks that events spooled while the logger
+// was down reach it before newer ones.
+func TestDispatcherReplayOrder(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// recovered is whether the logger takes events again when the
+		// newer ones are flushed
+		recovered   bool
+		wantSent    []int64
+		wantSpooled []int64
+	}{
+		{
+			name:      "replayed before newer",
+			recovered: true,
+			wantSent:  []int64{1, 2, 3, 4},
+		},
+		{
+			name:        "newer spooled behind while down",
+			wantSpooled: []int64{1, 2, 3, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{down: true}
+			cfg := testConfig(t)
+			cfg.BreakerThreshold = 1
+			cfg.BreakerCooldown = cooldown
+			d := newTestDispatcher(t, sender, cfg)
+
+			d.flush(testEvents(1, 2))
+
+			if got := spooledIDs(t, cfg.SpoolFile); len(got) != 2 {
+				t.Fatalf("spooled %v while the logger was down, want [1 2]", got)
+			}
+
+			if tt.recovered {
+				time.Sleep(cooldown)
+				sender.setDown(false)
+			}
+
+			d.flush(testEvents(3, 4))
+
+			_, sent := sender.stats()
+			if fmt.Sprint(sent) != fmt.Sprint(tt.wantSent) {
+				t.Errorf("sent %v, want %v", sent, tt.wantSent)
+			}
+			if got := spooledIDs(t, cfg.SpoolFile); fmt.Sprint(got) != fmt.Sprint(tt.wantSpooled) {
+				t.Errorf("spooled %v, want %v", got, tt.wantSpooled)
+			}
+		})
+	}
+}
+
+func TestDispatcherCloseFlushes(t *testing.T) {
+	tests := []struct {
+		name        string
+		down        bool
+		wantSent    []int64
+		wantSpooled []int64
+	}{
+		{
+			name:     "queued events are sent",
+			wantSent: []int64{1, 2, 3, 4, 5},
+		},
+		{
+			name:        "queued events are spooled while down",
+			down:        true,
+			wantSpooled: []int64{1, 2, 3, 4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{down: tt.down}
+			cfg := testConfig(t)
+			cfg.MaxRetries = 3
+			cfg.RetryBaseDelay = time.Hour
+			cfg.RetryMaxDelay = time.Hour
+
+			d, err := NewDispatcher(sender, cfg, nopMetrics{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, ev := range testEvents(1, 2, 3, 4, 5) {
+				if err := d.SendLogRequest(context.Background(), ev.Item); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// retries are an hour apart, Close must not wait for them
+			if err := d.Close(ctx); err != nil {
+				t.Fatalf("Close returned %v", err)
+			}
+
+			if _, sent := sender.stats(); fmt.Sprint(sent) != fmt.Sprint(tt.wantSent) {
+				t.Errorf("sent %v, want %v", sent, tt.wantSent)
+			}
+			if got := spooledIDs(t, cfg.SpoolFile); fmt.Sprint(got) != fmt.Sprint(tt.wantSpooled) {
+				t.Errorf("spooled %v, want %v", got, tt.wantSpooled)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package grpc_client
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	"github.com/jackietana/crud-app/pkg/api/bookpb"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// methodRoles lists the book methods that need more than a reader, the
+// same ones that need the editor role over REST.
+var methodRoles = map[string]domain.Role{
+	bookpb.BookService_CreateBook_FullMethodName: domain.RoleEditor,
+	bookpb.BookService_UpdateBook_FullMethodName: domain.RoleEditor,
+	bookpb.BookService_DeleteBook_FullMethodName: domain.RoleEditor,
+}
+
+// authInterceptor checks the bearer token of every book call and puts
+// the user in the context. Health and reflection calls are not checked.
+type authInterceptor struct {
+	users TokenParser
+}
+
+func (a authInterceptor) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (a authInterceptor) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	ctx, err := a.authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authorizedStream{ServerStream: ss, ctx: ctx})
+}
+
+func (a authInterceptor) authorize(ctx context.Context, method string) (context.Context, error) {
+	if !strings.HasPrefix(method, "/"+bookpb.BookService_ServiceDesc.ServiceName+"/") {
+		return ctx, nil
+	}
+
+	token, err := getTokenFromMetadata(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"interceptor": "auth", "method": method}).Error(err)
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	claims, err := a.users.ParseToken(ctx, token)
+	if err != nil {
+		log.WithFields(log.Fields{"interceptor": "auth", "method": method}).Error(err)
+		if errors.Is(err, domain.ErrTokenCheckFailed) {
+			return ctx, status.Error(codes.Internal, domain.ErrTokenCheckFailed.Error())
+		}
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if role, ok := methodRoles[method]; ok && !claims.Role.Includes(role) {
+		log.WithFields(log.Fields{
+			"interceptor": "auth",
+			"method":      method,
+			"required":    role,
+			"role":        claims.Role,
+		}).Error(domain.ErrForbidden)
+		return ctx, status.Error(codes.PermissionDenied, domain.ErrForbidden.Error())
+	}
+
+	return domain.WithUserID(ctx, claims.UserID), nil
+}
+
+func getTokenFromMetadata(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(authMetadataKey)
+	if len(values) == 0 {
+		return "", errors.New("empty authorization metadata")
+	}
+
+	parts := strings.Split(values[0], " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", errors.New("invalid authorization metadata")
+	}
+
+	if len(parts[1]) == 0 {
+		return "", errors.New("token is empty")
+	}
+
+	return parts[1], nil
+}
+
+// authorizedStream carries the context with the authenticated user.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
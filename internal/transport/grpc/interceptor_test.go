@@ -0,0 +1,63 @@
+package grpc_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	"github.com/jackietana/crud-app/pkg/api/bookpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type fakeTokenParser struct {
+	err error
+}
+
+func (p fakeTokenParser) ParseToken(context.Context, string) (domain.TokenClaims, error) {
+	return domain.TokenClaims{UserID: 1, Role: domain.RoleReader}, p.err
+}
+
+func TestAuthInterceptorCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{
+			name: "valid token",
+			want: codes.OK,
+		},
+		{
+			name: "revoked token",
+			err:  domain.ErrTokenRevoked,
+			want: codes.Unauthenticated,
+		},
+		{
+			name: "invalid token",
+			err:  errors.New("signature is invalid"),
+			want: codes.Unauthenticated,
+		},
+		{
+			name: "denylist unavailable",
+			err:  fmt.Errorf("%w: connection refused", domain.ErrTokenCheckFailed),
+			want: codes.Internal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := authInterceptor{fakeTokenParser{tt.err}}
+			ctx := metadata.NewIncomingContext(context.Background(),
+				metadata.Pairs(authMetadataKey, "Bearer token"))
+
+			_, err := a.authorize(ctx, bookpb.BookService_GetBook_FullMethodName)
+			if code := status.Code(err); code != tt.want {
+				t.Errorf("authorize returned %v, want %v", code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package grpc_client
+
+import (
+	"context"
+
+	logger "github.com/jackietana/grpc-logger/pkg/domain"
+)
+
+// NopClient stands in for Client when the logger is disabled. It drops
+// every event.
+type NopClient struct{}
+
+func (NopClient) SendLogRequest(ctx context.Context, req logger.LogItem) error {
+	return nil
+}
+
+func (NopClient) CloseConnection() error {
+	return nil
+}
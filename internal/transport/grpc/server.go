@@ -0,0 +1,96 @@
+package grpc_client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	"github.com/jackietana/crud-app/pkg/api/bookpb"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+type BookService interface {
+	CreateBook(ctx context.Context, book domain.Book) (domain.Book, error)
+	GetBookById(ctx context.Context, id int) (domain.Book, error)
+	GetBooks(ctx context.Context, q domain.BookQuery) (domain.BookPage, error)
+	UpdateBook(ctx context.Context, id int, book domain.Book, version int) (domain.Book, error)
+	DeleteBook(ctx context.Context, id, version int) error
+	WatchBooks(ctx context.Context) <-chan domain.BookEvent
+}
+
+type TokenParser interface {
+	ParseToken(ctx context.Context, accessToken string) (domain.TokenClaims, error)
+}
+
+// Server serves the book API over gRPC, along with the standard health
+// and reflection services.
+type Server struct {
+	port   int
+	server *grpc.Server
+	health *health.Server
+
+	// stopping ends watch streams, which would otherwise hold up a
+	// graceful stop
+	stopping chan struct{}
+	stopOnce sync.Once
+}
+
+func NewServer(port int, bookService BookService, users TokenParser, requireVersion bool) *Server {
+	auth := authInterceptor{users}
+
+	server := grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(auth.unary),
+		grpc.ChainStreamInterceptor(auth.stream),
+	)
+
+	healthServer := health.NewServer()
+	stopping := make(chan struct{})
+
+	bookpb.RegisterBookServiceServer(server, &bookServer{books: bookService, stopping: stopping, requireVersion: requireVersion})
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+
+	return &Server{port: port, server: server, health: healthServer, stopping: stopping}
+}
+
+// ListenAndServe blocks until the server is stopped.
+func (s *Server) ListenAndServe() error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return err
+	}
+
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	s.health.SetServingStatus(bookpb.BookService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+
+	return s.server.Serve(lis)
+}
+
+// Shutdown reports not serving, ends watch streams and waits for
+// in-flight calls to finish. Calls still running are cut off when ctx
+// is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.health.Shutdown()
+	s.stopOnce.Do(func() { close(s.stopping) })
+
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
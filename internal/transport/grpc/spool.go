@@ -0,0 +1,233 @@
+package grpc_client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// spool is an append-only file of audit events the logger could not take.
+// Events are stored one JSON object per line.
+type spool struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openSpool(path string) (*spool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &spool{path: path, file: f}, nil
+}
+
+func (s *spool) append(events ...event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := bufio.NewWriter(s.file)
+	if err := encodeEvents(w, events); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+// prepend writes events ahead of the ones in the spool, so events spilled
+// during a replay stay behind the older ones it could not send. The spool
+// is rewritten to a temporary file that then replaces it.
+func (s *spool) prepend(events ...event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmpPath := s.path + ".tmp"
+	if err := s.writeAhead(tmpPath, events); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// the old file was replaced, appends go to the new one
+	if err := s.file.Close(); err != nil {
+		log.WithField("spool", s.path).Error(err)
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	s.file = f
+
+	return nil
+}
+
+// writeAhead writes events, then the spooled ones, to path. s.mu must be
+// held.
+func (s *spool) writeAhead(path string, events []event) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := encodeEvents(w, events); err != nil {
+		return err
+	}
+
+	spooled, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer spooled.Close()
+
+	if _, err := io.Copy(w, spooled); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func encodeEvents(w io.Writer, events []event) error {
+	enc := json.NewEncoder(w)
+
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pending reports whether there is anything to replay.
+func (s *spool) pending() bool {
+	if _, err := os.Stat(s.replayPath()); err == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := s.file.Stat()
+
+	return err == nil && info.Size() > 0
+}
+
+// replay hands spooled events to send in order, stopping at the first
+// error. Events that were not sent are written back to the spool, ahead
+// of those spilled meanwhile: the spool is moved aside first, so they are
+// kept, but they are newer.
+func (s *spool) replay(send func(event) error) error {
+	if err := s.rotate(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(s.replayPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		rest    []event
+		sendErr error
+	)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			log.WithField("spool", s.path).Error(err)
+			continue
+		}
+
+		if sendErr == nil {
+			sendErr = send(ev)
+			if sendErr == nil {
+				continue
+			}
+		}
+
+		rest = append(rest, ev)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(rest) > 0 {
+		if err := s.prepend(rest...); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(s.replayPath()); err != nil {
+		return err
+	}
+
+	return sendErr
+}
+
+// rotate moves the spool to the replay file, unless a replay file is
+// left over from an interrupted replay, which is then replayed first.
+func (s *spool) rotate() error {
+	if _, err := os.Stat(s.replayPath()); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(s.path, s.replayPath()); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	s.file = f
+
+	return nil
+}
+
+func (s *spool) replayPath() string {
+	return s.path + ".replay"
+}
+
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
@@ -0,0 +1,155 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackietana/crud-app/internal/domain"
+	log "github.com/sirupsen/logrus"
+)
+
+// @Summary Set user role
+// @Description assign reader, editor or admin role to a user
+// @Tags admin
+// @Accept json
+// @Produce plain
+// @Param id path int true "User ID"
+// @Param role body domain.UserRole true "New role"
+// @Security TokenAuth
+// @Success 200 {string} string "Role successfully updated"
+// @Failure 400 {string} string "invalid role"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "user not found"
+// @Router /admin/users/{id}/role [put]
+func (h *Handler) setUserRole(c *gin.Context) {
+	id, err := getId(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "setUserRole",
+			"issue":   "getId error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var input domain.UserRole
+	if err := c.BindJSON(&input); err != nil {
+		log.WithFields(log.Fields{
+			"handler": "setUserRole",
+			"issue":   "bindJson error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.userService.SetRole(c.Request.Context(), id, input.Role)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "setUserRole",
+			"issue":   "service error",
+		}).Error(err)
+
+		switch {
+		case errors.Is(err, domain.ErrInvalidRole):
+			http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, domain.ErrUserNotFound):
+			http.Error(c.Writer, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.String(http.StatusOK, "Role successfully updated")
+	log.WithFields(log.Fields{"id": id, "role": input.Role}).Info("Handler: setUserRole")
+}
+
+// @Summary Outbox status
+// @Description count audit events not yet published and list those pending for too long
+// @Tags admin
+// @Produce json
+// @Security TokenAuth
+// @Success 200 {object} domain.OutboxStatus
+// @Failure 403 {string} string "forbidden"
+// @Failure 500 {string} string "internal error"
+// @Router /admin/outbox [get]
+func (h *Handler) getOutboxStatus(c *gin.Context) {
+	status, err := h.outboxService.GetStatus(c.Request.Context())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "getOutboxStatus",
+			"issue":   "service error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+	log.WithField("pending", status.Pending).Info("Handler: getOutboxStatus")
+}
+
+// @Summary Cache stats
+// @Description size, bounds, hits, misses and evictions of the book cache on this instance
+// @Tags admin
+// @Produce json
+// @Security TokenAuth
+// @Success 200 {object} domain.CacheStats
+// @Failure 403 {string} string "forbidden"
+// @Router /admin/cache [get]
+func (h *Handler) getCacheStats(c *gin.Context) {
+	stats := h.bookService.CacheStats(c.Request.Context())
+
+	c.JSON(http.StatusOK, stats)
+	log.WithField("entries", stats.Entries).Info("Handler: getCacheStats")
+}
+
+// @Summary Flush cache
+// @Description drop every cached book and listing
+// @Tags admin
+// @Produce plain
+// @Security TokenAuth
+// @Success 200 {string} string "Cache successfully flushed"
+// @Failure 403 {string} string "forbidden"
+// @Failure 500 {string} string "internal error"
+// @Router /admin/cache [delete]
+func (h *Handler) flushCache(c *gin.Context) {
+	if err := h.bookService.FlushCache(c.Request.Context()); err != nil {
+		log.WithFields(log.Fields{
+			"handler": "flushCache",
+			"issue":   "service error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.String(http.StatusOK, "Cache successfully flushed")
+	log.Info("Handler: flushCache")
+}
+
+// @Summary Evict book from cache
+// @Description drop a book from the cache, the next read loads it from the database
+// @Tags admin
+// @Produce plain
+// @Param id path int true "Book ID"
+// @Security TokenAuth
+// @Success 200 {string} string "Book successfully evicted"
+// @Failure 400 {string} string "invalid id"
+// @Failure 403 {string} string "forbidden"
+// @Router /admin/cache/books/{id} [delete]
+func (h *Handler) evictCachedBook(c *gin.Context) {
+	id, err := getId(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "evictCachedBook",
+			"issue":   "getId error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.bookService.EvictCachedBook(c.Request.Context(), id)
+
+	c.String(http.StatusOK, "Book successfully evicted")
+	log.WithField("id", id).Info("Handler: evictCachedBook")
+}
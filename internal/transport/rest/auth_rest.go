@@ -1,7 +1,6 @@
 package rest
 
 import (
-	"context"
 	"errors"
 	"net/http"
 
@@ -26,7 +25,7 @@ func (h *Handler) signUp(c *gin.Context) {
 		return
 	}
 
-	if err := h.userService.SignUp(context.TODO(), user); err != nil {
+	if err := h.userService.SignUp(c.Request.Context(), user); err != nil {
 		log.WithField("handler", "signUp").Error(err)
 		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
 		return
@@ -52,7 +51,7 @@ func (h *Handler) signIn(c *gin.Context) {
 		return
 	}
 
-	accessToken, refreshToken, err := h.userService.SignIn(context.TODO(), user)
+	accessToken, refreshToken, err := h.userService.SignIn(c.Request.Context(), user, getSessionMeta(c))
 	if err != nil {
 		if errors.Is(err, domain.ErrUserNotFound) {
 			log.WithField("handler", "signIn").Error("user not found")
@@ -82,11 +81,16 @@ func (h *Handler) refresh(c *gin.Context) {
 		return
 	}
 
-	log.WithField("handler", "refresh").Infof("%s", cookie)
-
-	accessToken, refreshToken, err := h.userService.RefreshTokens(c.Request.Context(), cookie)
+	accessToken, refreshToken, err := h.userService.RefreshTokens(c.Request.Context(), cookie, getSessionMeta(c))
 	if err != nil {
 		log.WithField("handler", "refresh").Error(err)
+
+		if errors.Is(err, domain.ErrInvalidRefreshToken) || errors.Is(err, domain.ErrRefreshTokenExpired) ||
+			errors.Is(err, domain.ErrRefreshTokenReused) || errors.Is(err, domain.ErrSessionRevoked) {
+			http.Error(c.Writer, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
 		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -96,3 +100,101 @@ func (h *Handler) refresh(c *gin.Context) {
 		"token": accessToken,
 	})
 }
+
+// @Summary Log out
+// @Description end the current session and revoke its tokens
+// @Tags auth
+// @Produce plain
+// @Security TokenAuth
+// @Success 200 {string} string "Successfully logged out"
+// @Failure 401 {string} string
+// @Router /auth/logout [post]
+func (h *Handler) logout(c *gin.Context) {
+	claims, _ := c.Get("claims")
+	if err := h.userService.Logout(c.Request.Context(), claims.(domain.TokenClaims)); err != nil {
+		log.WithField("handler", "logout").Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.SetCookie("refresh-token", "", -1, "/auth", "localhost", false, true)
+	c.String(http.StatusOK, "Successfully logged out")
+}
+
+// @Summary Log out everywhere
+// @Description end every session of the current user and revoke their tokens
+// @Tags auth
+// @Produce plain
+// @Security TokenAuth
+// @Success 200 {string} string "Successfully logged out"
+// @Failure 401 {string} string
+// @Router /auth/logout-all [post]
+func (h *Handler) logoutAll(c *gin.Context) {
+	claims, _ := c.Get("claims")
+	if err := h.userService.LogoutAll(c.Request.Context(), claims.(domain.TokenClaims)); err != nil {
+		log.WithField("handler", "logoutAll").Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.SetCookie("refresh-token", "", -1, "/auth", "localhost", false, true)
+	c.String(http.StatusOK, "Successfully logged out")
+}
+
+// @Summary List sessions
+// @Description list active sessions of the current user
+// @Tags auth
+// @Produce json
+// @Security TokenAuth
+// @Success 200 {object} []domain.Session
+// @Failure 401 {string} string
+// @Router /auth/sessions [get]
+func (h *Handler) getSessions(c *gin.Context) {
+	sessions, err := h.userService.GetSessions(c.Request.Context(), c.GetInt("userId"), c.GetInt("sessionId"))
+	if err != nil {
+		log.WithField("handler", "getSessions").Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// @Summary Revoke session
+// @Description sign out a session of the current user
+// @Tags auth
+// @Produce plain
+// @Param id path int true "Session ID"
+// @Security TokenAuth
+// @Success 200 {string} string "Session successfully revoked"
+// @Failure 404 {string} string "session not found"
+// @Router /auth/sessions/{id} [delete]
+func (h *Handler) deleteSession(c *gin.Context) {
+	id, err := getId(c)
+	if err != nil {
+		log.WithField("handler", "deleteSession").Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.userService.RevokeSession(c.Request.Context(), c.GetInt("userId"), id); err != nil {
+		log.WithField("handler", "deleteSession").Error(err)
+
+		if errors.Is(err, domain.ErrSessionNotFound) {
+			http.Error(c.Writer, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.String(http.StatusOK, "Session successfully revoked")
+}
+
+func getSessionMeta(c *gin.Context) domain.SessionMeta {
+	return domain.SessionMeta{
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	}
+}
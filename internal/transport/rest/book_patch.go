@@ -0,0 +1,98 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/jackietana/crud-app/internal/domain"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+var (
+	errUnsupportedPatch   = errors.New("unsupported patch content type")
+	errMalformedPatch     = errors.New("malformed patch")
+	errUnprocessablePatch = errors.New("patch cannot be applied")
+	errPatchTestFailed    = errors.New("patch test failed")
+)
+
+// bookPatchFields are the book fields a patch may not remove.
+var bookPatchFields = []string{"name", "description", "author", "is_free", "genres"}
+
+// newBookPatch returns a function applying the request body to a book:
+// an RFC 7396 merge patch, also accepted as plain JSON, or an RFC 6902
+// JSON Patch. Both work on the JSON form of the book.
+func newBookPatch(contentType string, body []byte) (func(domain.Book) (domain.Book, error), error) {
+	switch contentType {
+	case mergePatchContentType, "application/json":
+		if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) || !json.Valid(body) {
+			return nil, fmt.Errorf("%w: merge patch must be a JSON object", errMalformedPatch)
+		}
+
+		return func(book domain.Book) (domain.Book, error) {
+			return applyBookPatch(book, func(doc []byte) ([]byte, error) {
+				return jsonpatch.MergePatch(doc, body)
+			})
+		}, nil
+	case jsonPatchContentType:
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errMalformedPatch, err)
+		}
+
+		return func(book domain.Book) (domain.Book, error) {
+			return applyBookPatch(book, patch.Apply)
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q, use %s or %s", errUnsupportedPatch, contentType,
+			mergePatchContentType, jsonPatchContentType)
+	}
+}
+
+func applyBookPatch(book domain.Book, apply func(doc []byte) ([]byte, error)) (domain.Book, error) {
+	doc, err := json.Marshal(book)
+	if err != nil {
+		return book, err
+	}
+
+	patched, err := apply(doc)
+	if err != nil {
+		if errors.Is(err, jsonpatch.ErrTestFailed) {
+			return book, fmt.Errorf("%w: %v", errPatchTestFailed, err)
+		}
+
+		return book, fmt.Errorf("%w: %v", errUnprocessablePatch, err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patched, &fields); err != nil {
+		return book, fmt.Errorf("%w: %v", errUnprocessablePatch, err)
+	}
+
+	for _, field := range bookPatchFields {
+		if value, ok := fields[field]; !ok || string(value) == "null" {
+			return book, fmt.Errorf("%w: %s cannot be removed", errUnprocessablePatch, field)
+		}
+	}
+
+	var result domain.Book
+
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&result); err != nil {
+		return book, fmt.Errorf("%w: %v", errUnprocessablePatch, err)
+	}
+
+	if result.ID != book.ID || !result.PublishedAt.Equal(book.PublishedAt) || result.Version != book.Version ||
+		result.DeletedAt != nil {
+		return book, fmt.Errorf("%w: id, published_at, version and deleted_at are read-only", errUnprocessablePatch)
+	}
+
+	return result, nil
+}
@@ -1,9 +1,12 @@
 package rest
 
 import (
-	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackietana/crud-app/internal/domain"
@@ -17,6 +20,7 @@ import (
 // @Produce json
 // @Security TokenAuth
 // @Success 201 {string} string "Book successfully created"
+// @Failure 403 {string} string "forbidden"
 // @Router /books [post]
 func (h *Handler) createBook(c *gin.Context) {
 	var book domain.Book
@@ -29,7 +33,7 @@ func (h *Handler) createBook(c *gin.Context) {
 		return
 	}
 
-	err := h.bookService.CreateBook(context.TODO(), book)
+	created, err := h.bookService.CreateBook(c.Request.Context(), book)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"handler": "createBook",
@@ -40,7 +44,7 @@ func (h *Handler) createBook(c *gin.Context) {
 	}
 
 	c.String(http.StatusCreated, "Book successfully created")
-	log.Info("Handler: createBook")
+	log.WithField("id", created.ID).Info("Handler: createBook")
 }
 
 // @Summary Get specific book
@@ -49,7 +53,10 @@ func (h *Handler) createBook(c *gin.Context) {
 // @Produce json
 // @Param id path int true "Book ID"
 // @Security TokenAuth
+// @Param If-None-Match header string false "ETag of a cached copy"
 // @Success 200 {object} domain.Book
+// @Header 200 {string} ETag "book version"
+// @Success 304 "Not Modified"
 // @Failure 404 {string} string "book not found"
 // @Router /books/{id} [get]
 func (h *Handler) getBookById(c *gin.Context) {
@@ -63,7 +70,7 @@ func (h *Handler) getBookById(c *gin.Context) {
 		return
 	}
 
-	book, err := h.bookService.GetBookById(context.TODO(), id)
+	book, err := h.bookService.GetBookById(c.Request.Context(), id)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"handler": "getBookById",
@@ -73,42 +80,140 @@ func (h *Handler) getBookById(c *gin.Context) {
 		return
 	}
 
+	etag := bookETag(book)
+	c.Header("ETag", etag)
+
+	if ifNoneMatch(c, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
 	c.JSON(http.StatusOK, book)
 	log.Info("Handler: getBookById")
 }
 
 // @Summary List books
-// @Description get all books
+// @Description get books with filtering, sorting and pagination
 // @Tags books
 // @Produce json
+// @Param limit query int false "Page size (max 100)"
+// @Param offset query int false "Number of books to skip"
+// @Param cursor query string false "Cursor from the previous page"
+// @Param author query string false "Author name"
+// @Param genres query string false "Comma separated genres"
+// @Param genres_match query string false "any or all"
+// @Param is_free query bool false "Free books only"
+// @Param published_from query string false "RFC3339 or YYYY-MM-DD"
+// @Param published_to query string false "RFC3339 or YYYY-MM-DD"
+// @Param sort query string false "Sort field, prefix with - for descending"
+// @Param order query string false "asc or desc"
 // @Security TokenAuth
-// @Success 200 {object} []domain.Book
+// @Success 200 {object} domain.BookPage
+// @Failure 400 {string} string "invalid book query"
+// @Param If-None-Match header string false "ETag of a cached page"
+// @Header 200 {string} ETag "weak ETag of the page"
+// @Success 304 "Not Modified"
 // @Router /books [get]
 func (h *Handler) getBooks(c *gin.Context) {
-	books, err := h.bookService.GetBooks(context.TODO())
+	q, err := getBookQuery(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "getBooks",
+			"issue":   "getBookQuery error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.bookService.GetBooks(c.Request.Context(), q)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"handler": "getBooks",
 			"issue":   "service error",
 		}).Error(err)
+
+		if errors.Is(err, domain.ErrInvalidBookQuery) || errors.Is(err, domain.ErrInvalidCursor) {
+			http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	c.JSON(http.StatusOK, books)
+	etag := pageETag(page)
+	c.Header("ETag", etag)
+
+	if ifNoneMatch(c, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
 
 	log.Info("Handler: getBooks")
 }
 
+// @Summary Search books
+// @Description full-text search over book name, author and description; highlights are escaped HTML with matches in <mark>
+// @Tags books
+// @Produce json
+// @Param q query string true "Search query"
+// @Param limit query int false "Page size (max 100)"
+// @Param offset query int false "Number of results to skip"
+// @Security TokenAuth
+// @Success 200 {object} domain.BookSearchPage
+// @Failure 400 {string} string "invalid book query"
+// @Router /books/search [get]
+func (h *Handler) searchBooks(c *gin.Context) {
+	limit, offset, err := getPagination(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "searchBooks",
+			"issue":   "getPagination error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := domain.BookSearchQuery{Query: c.Query("q"), Limit: limit, Offset: offset}
+
+	page, err := h.bookService.SearchBooks(c.Request.Context(), q)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "searchBooks",
+			"issue":   "service error",
+		}).Error(err)
+
+		if errors.Is(err, domain.ErrInvalidBookQuery) {
+			http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+
+	log.Info("Handler: searchBooks")
+}
+
 // @Summary Update book
 // @Description update existing book
 // @Tags books
 // @Accept json
 // @Produce plain
 // @Param id path int true "Book ID"
+// @Param If-Match header string false "ETag of the book being replaced"
 // @Security TokenAuth
 // @Success 200 {string} string "Book successfully updated"
+// @Header 200 {string} ETag "new book version"
+// @Failure 400 {string} string "invalid If-Match"
 // @Failure 404 {string} string "book not found"
+// @Failure 403 {string} string "forbidden"
+// @Failure 412 {string} string "ETag does not match"
+// @Failure 428 {string} string "If-Match required"
 // @Router /books/{id} [put]
 func (h *Handler) updateBook(c *gin.Context) {
 	id, err := getId(c)
@@ -121,6 +226,16 @@ func (h *Handler) updateBook(c *gin.Context) {
 		return
 	}
 
+	version, err := h.ifMatchVersion(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "updateBook",
+			"issue":   "precondition error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), writeStatus(err))
+		return
+	}
+
 	var book domain.Book
 	if err := c.BindJSON(&book); err != nil {
 		log.WithFields(log.Fields{
@@ -131,28 +246,125 @@ func (h *Handler) updateBook(c *gin.Context) {
 		return
 	}
 
-	err = h.bookService.UpdateBook(context.TODO(), id, book)
+	updated, err := h.bookService.UpdateBook(c.Request.Context(), id, book, version)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"handler": "updateBook",
 			"issue":   "service error",
 		}).Error(err)
-		http.Error(c.Writer, err.Error(), http.StatusNotFound)
+		http.Error(c.Writer, err.Error(), writeStatus(err))
 		return
 	}
 
+	c.Header("ETag", bookETag(updated))
+
 	c.String(http.StatusOK, "Book successfully updated")
 	log.Info("Handler: updateBook")
 }
 
+// @Summary Patch book
+// @Description change some fields of a book with an RFC 7396 merge patch or an RFC 6902 JSON Patch
+// @Tags books
+// @Accept application/merge-patch+json,application/json-patch+json
+// @Produce json
+// @Param id path int true "Book ID"
+// @Param patch body object true "Merge patch object or JSON Patch operations"
+// @Param If-Match header string false "ETag of the book being patched"
+// @Security TokenAuth
+// @Success 200 {object} domain.Book
+// @Header 200 {string} ETag "new book version"
+// @Failure 400 {string} string "malformed patch"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "book not found"
+// @Failure 409 {string} string "patch test failed"
+// @Failure 412 {string} string "ETag does not match"
+// @Failure 415 {string} string "unsupported patch content type"
+// @Failure 422 {string} string "patch cannot be applied"
+// @Failure 428 {string} string "If-Match required"
+// @Router /books/{id} [patch]
+func (h *Handler) patchBook(c *gin.Context) {
+	id, err := getId(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "patchBook",
+			"issue":   "getId error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := h.ifMatchVersion(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "patchBook",
+			"issue":   "precondition error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), writeStatus(err))
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "patchBook",
+			"issue":   "read body error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	patch, err := newBookPatch(c.ContentType(), body)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "patchBook",
+			"issue":   "patch error",
+		}).Error(err)
+
+		if errors.Is(err, errUnsupportedPatch) {
+			http.Error(c.Writer, err.Error(), http.StatusUnsupportedMediaType)
+		} else {
+			http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	book, err := h.bookService.PatchBook(c.Request.Context(), id, version, patch)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "patchBook",
+			"issue":   "service error",
+		}).Error(err)
+
+		switch {
+		case errors.Is(err, errPatchTestFailed):
+			http.Error(c.Writer, err.Error(), http.StatusConflict)
+		case errors.Is(err, errUnprocessablePatch), errors.Is(err, domain.ErrInvalidBook):
+			http.Error(c.Writer, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			http.Error(c.Writer, err.Error(), writeStatus(err))
+		}
+		return
+	}
+
+	c.Header("ETag", bookETag(book))
+	c.JSON(http.StatusOK, book)
+	log.WithField("id", id).Info("Handler: patchBook")
+}
+
 // @Summary Delete book
-// @Description delete book by id
+// @Description move book to the trash, or delete it for good with purge=true (admin only)
 // @Tags books
 // @Produce plain
 // @Param id path int true "Book ID"
+// @Param purge query bool false "Delete for good, also from the trash"
+// @Param If-Match header string false "ETag of the book being removed"
 // @Security TokenAuth
 // @Success 200 {string} string "Book successfully removed"
+// @Failure 400 {string} string "invalid If-Match"
 // @Failure 404 {string} string "book not found"
+// @Failure 403 {string} string "forbidden"
+// @Failure 412 {string} string "ETag does not match"
+// @Failure 428 {string} string "If-Match required"
 // @Router /books/{id} [delete]
 func (h *Handler) deleteBook(c *gin.Context) {
 	id, err := getId(c)
@@ -165,18 +377,53 @@ func (h *Handler) deleteBook(c *gin.Context) {
 		return
 	}
 
-	err = h.bookService.DeleteBook(context.TODO(), id)
+	version, err := h.ifMatchVersion(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "deleteBook",
+			"issue":   "precondition error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), writeStatus(err))
+		return
+	}
+
+	purge, err := strconv.ParseBool(c.DefaultQuery("purge", "false"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "deleteBook",
+			"issue":   "purge error",
+		}).Error(err)
+		http.Error(c.Writer, "purge must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	if purge {
+		// purging skips the trash, only admins may do it
+		if role, _ := c.Get("role"); !hasRole(role, domain.RoleAdmin) {
+			log.WithFields(log.Fields{
+				"handler": "deleteBook",
+				"issue":   "purge forbidden",
+				"role":    role,
+			}).Error(domain.ErrForbidden)
+			http.Error(c.Writer, domain.ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+
+		err = h.bookService.PurgeBook(c.Request.Context(), id, version)
+	} else {
+		err = h.bookService.DeleteBook(c.Request.Context(), id, version)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"handler": "deleteBook",
 			"issue":   "service error",
 		}).Error(err)
-		http.Error(c.Writer, err.Error(), http.StatusNotFound)
+		http.Error(c.Writer, err.Error(), writeStatus(err))
 		return
 	}
 
 	c.String(http.StatusOK, "Book successfully removed")
-	log.Info("Handler: deleteBook")
+	log.WithFields(log.Fields{"id": id, "purge": purge}).Info("Handler: deleteBook")
 }
 
 func getId(c *gin.Context) (int, error) {
@@ -184,3 +431,86 @@ func getId(c *gin.Context) (int, error) {
 
 	return strconv.Atoi(id)
 }
+
+func getPagination(c *gin.Context) (int, int, error) {
+	var limit, offset int
+	var err error
+
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil {
+			return 0, 0, fmt.Errorf("%w: limit", domain.ErrInvalidBookQuery)
+		}
+	}
+
+	if v := c.Query("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil {
+			return 0, 0, fmt.Errorf("%w: offset", domain.ErrInvalidBookQuery)
+		}
+	}
+
+	return limit, offset, nil
+}
+
+func getBookQuery(c *gin.Context) (domain.BookQuery, error) {
+	var (
+		q   domain.BookQuery
+		err error
+	)
+
+	if q.Limit, q.Offset, err = getPagination(c); err != nil {
+		return q, err
+	}
+
+	q.Cursor = c.Query("cursor")
+	q.Author = c.Query("author")
+	q.GenresMatch = c.Query("genres_match")
+
+	for _, v := range c.QueryArray("genres") {
+		for _, genre := range strings.Split(v, ",") {
+			if genre = strings.TrimSpace(genre); genre != "" {
+				q.Genres = append(q.Genres, genre)
+			}
+		}
+	}
+
+	if v := c.Query("is_free"); v != "" {
+		isFree, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("%w: is_free", domain.ErrInvalidBookQuery)
+		}
+		q.IsFree = &isFree
+	}
+
+	if v := c.Query("published_from"); v != "" {
+		from, err := parseTime(v)
+		if err != nil {
+			return q, fmt.Errorf("%w: published_from", domain.ErrInvalidBookQuery)
+		}
+		q.PublishedFrom = &from
+	}
+
+	if v := c.Query("published_to"); v != "" {
+		to, err := parseTime(v)
+		if err != nil {
+			return q, fmt.Errorf("%w: published_to", domain.ErrInvalidBookQuery)
+		}
+		q.PublishedTo = &to
+	}
+
+	q.SortBy = c.Query("sort")
+	q.SortOrder = c.Query("order")
+	if strings.HasPrefix(q.SortBy, "-") {
+		q.SortBy = strings.TrimPrefix(q.SortBy, "-")
+		q.SortOrder = domain.SortDesc
+	}
+
+	return q, nil
+}
+
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.DateOnly, v)
+}
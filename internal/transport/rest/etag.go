@@ -0,0 +1,111 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackietana/crud-app/internal/domain"
+)
+
+var errInvalidIfMatch = errors.New("If-Match takes a single book ETag or *")
+
+// bookETag is a strong ETag of a book. It is the book version, which
+// every write increments.
+func bookETag(book domain.Book) string {
+	return strconv.Quote(strconv.Itoa(book.Version))
+}
+
+// pageETag is a weak ETag of a books page, derived from the versions of
+// the books on it and the page position.
+func pageETag(page domain.BookPage) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|%d|%d|%s", page.Total, page.Limit, page.Offset, page.NextCursor)
+	for _, book := range page.Books {
+		fmt.Fprintf(h, "|%d:%d", book.ID, book.Version)
+	}
+
+	return "W/" + strconv.Quote(hex.EncodeToString(h.Sum(nil))[:32])
+}
+
+// ifMatchVersion returns the book version If-Match requires, 0 when any
+// version will do. Without If-Match it fails with ErrPreconditionMissing
+// in strict mode.
+func (h *Handler) ifMatchVersion(c *gin.Context) (int, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		if h.opts.RequireIfMatch {
+			return 0, domain.ErrPreconditionMissing
+		}
+
+		return 0, nil
+	}
+
+	if header == "*" {
+		return 0, nil
+	}
+
+	if strings.Contains(header, ",") {
+		return 0, errInvalidIfMatch
+	}
+
+	// If-Match uses strong comparison, a weak ETag never matches
+	if strings.HasPrefix(header, "W/") {
+		return 0, domain.ErrVersionMismatch
+	}
+
+	tag, err := strconv.Unquote(header)
+	if err != nil {
+		return 0, errInvalidIfMatch
+	}
+
+	version, err := strconv.Atoi(tag)
+	if err != nil || version <= 0 {
+		return 0, domain.ErrVersionMismatch
+	}
+
+	return version, nil
+}
+
+// ifNoneMatch reports whether If-None-Match matches the ETag, using weak
+// comparison.
+func ifNoneMatch(c *gin.Context, etag string) bool {
+	header := strings.TrimSpace(c.GetHeader("If-None-Match"))
+	if header == "" {
+		return false
+	}
+
+	if header == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeStatus maps the errors of a conditional book write to a status.
+func writeStatus(err error) int {
+	switch {
+	case errors.Is(err, domain.ErrBookNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, domain.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, domain.ErrPreconditionMissing):
+		return http.StatusPreconditionRequired
+	case errors.Is(err, errInvalidIfMatch):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,376 @@
+package rest
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackietana/crud-app/internal/domain"
+	log "github.com/sirupsen/logrus"
+	"github.com/xuri/excelize/v2"
+)
+
+// exportFlushRows is how often the export is pushed to the client.
+const exportFlushRows = 500
+
+// @Summary Export books
+// @Description stream every book the filters select, without pagination; gzip is used when the client accepts it (except for xlsx, which is compressed already)
+// @Tags books
+// @Produce text/csv,application/x-ndjson,application/json,application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Param format query string false "csv (default), ndjson, json or xlsx"
+// @Param author query string false "Author name"
+// @Param genres query string false "Comma separated genres"
+// @Param genres_match query string false "any or all"
+// @Param is_free query bool false "Free books only"
+// @Param published_from query string false "RFC3339 or YYYY-MM-DD"
+// @Param published_to query string false "RFC3339 or YYYY-MM-DD"
+// @Param sort query string false "Sort field, prefix with - for descending"
+// @Param order query string false "asc or desc"
+// @Security TokenAuth
+// @Success 200 {file} file "Books export"
+// @Header 200 {string} Content-Disposition "attachment with the export file name"
+// @Failure 400 {string} string "invalid book query"
+// @Router /books/export [get]
+func (h *Handler) exportBooks(c *gin.Context) {
+	q, err := getBookQuery(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "exportBooks",
+			"issue":   "query error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := c.DefaultQuery("format", exportFormatCSV)
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		log.WithFields(log.Fields{
+			"handler": "exportBooks",
+			"issue":   "format error",
+		}).Error(errExportFormat)
+		http.Error(c.Writer, errExportFormat.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		out  bookWriter
+		gz   *gzip.Writer
+		rows int
+	)
+
+	// the response starts with the first book, so that a failing query
+	// can still be answered with an error status
+	start := func() error {
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", `attachment; filename="`+exportFileName(format, time.Now())+`"`)
+		c.Header("Vary", "Accept-Encoding")
+
+		var w io.Writer = c.Writer
+		if format != exportFormatXLSX && acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Header("Content-Encoding", "gzip")
+			gz = gzip.NewWriter(c.Writer)
+			w = gz
+		}
+
+		c.Status(http.StatusOK)
+
+		var err error
+		out, err = newBookWriter(format, w)
+
+		return err
+	}
+
+	flush := func() {
+		if f, ok := out.(interface{ Flush() error }); ok {
+			f.Flush()
+		}
+		if gz != nil {
+			gz.Flush()
+		}
+		c.Writer.Flush()
+	}
+
+	err = h.bookService.ExportBooks(c.Request.Context(), q, func(book domain.Book) error {
+		if out == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+
+		if err := out.Write(book); err != nil {
+			return err
+		}
+
+		if rows++; rows%exportFlushRows == 0 && format != exportFormatXLSX {
+			flush()
+		}
+
+		return nil
+	})
+	if err == nil && out == nil {
+		err = start()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "exportBooks",
+			"issue":   "service error",
+			"rows":    rows,
+		}).Error(err)
+
+		if out != nil {
+			// the status is sent, resetting the connection is all that is
+			// left to tell the client; a finished chunked body would pass
+			// for a complete export
+			out.Abort()
+			panic(http.ErrAbortHandler)
+		}
+
+		if errors.Is(err, domain.ErrInvalidBookQuery) {
+			http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.WithFields(log.Fields{"format": format, "rows": rows}).Info("Handler: exportBooks")
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+
+	return false
+}
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+	exportFormatJSON   = "json"
+	exportFormatXLSX   = "xlsx"
+
+	exportSheet = "Books"
+)
+
+var errExportFormat = fmt.Errorf("%w: format must be %s, %s, %s or %s", domain.ErrInvalidBookQuery,
+	exportFormatCSV, exportFormatNDJSON, exportFormatJSON, exportFormatXLSX)
+
+var exportContentTypes = map[string]string{
+	exportFormatCSV:    "text/csv; charset=utf-8",
+	exportFormatNDJSON: "application/x-ndjson",
+	exportFormatJSON:   "application/json",
+	exportFormatXLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// exportColumns are the CSV and XLSX columns. The CSV form can be
+// imported back.
+var exportColumns = []string{"id", "name", "description", "author", "is_free", "genres", "published_at", "version"}
+
+// bookWriter writes books in an export format as they come.
+type bookWriter interface {
+	Write(book domain.Book) error
+	// Close ends the document. It does not close the underlying writer.
+	Close() error
+	// Abort releases an export that failed part way. The handler then
+	// resets the connection, so what was written is never taken as whole.
+	Abort()
+}
+
+func newBookWriter(format string, w io.Writer) (bookWriter, error) {
+	switch format {
+	case exportFormatCSV:
+		return newCSVBookWriter(w)
+	case exportFormatNDJSON:
+		return &ndjsonBookWriter{enc: json.NewEncoder(w)}, nil
+	case exportFormatJSON:
+		return &jsonBookWriter{w: w}, nil
+	case exportFormatXLSX:
+		return newXLSXBookWriter(w)
+	default:
+		return nil, errExportFormat
+	}
+}
+
+func exportFileName(format string, now time.Time) string {
+	return fmt.Sprintf("books-%s.%s", now.UTC().Format("20060102-150405"), format)
+}
+
+type csvBookWriter struct {
+	w *csv.Writer
+}
+
+func newCSVBookWriter(w io.Writer) (*csvBookWriter, error) {
+	cw := csv.NewWriter(w)
+
+	return &csvBookWriter{cw}, cw.Write(exportColumns)
+}
+
+func (w *csvBookWriter) Write(b domain.Book) error {
+	return w.w.Write([]string{
+		strconv.Itoa(b.ID),
+		b.Name,
+		b.Description,
+		b.Author,
+		strconv.FormatBool(b.IsFree),
+		strings.Join(b.Genres, genresSeparator),
+		b.PublishedAt.Format(time.RFC3339),
+		strconv.Itoa(b.Version),
+	})
+}
+
+func (w *csvBookWriter) Flush() error {
+	w.w.Flush()
+
+	return w.w.Error()
+}
+
+func (w *csvBookWriter) Close() error {
+	return w.Flush()
+}
+
+func (w *csvBookWriter) Abort() {}
+
+type ndjsonBookWriter struct {
+	enc *json.Encoder
+}
+
+func (w *ndjsonBookWriter) Write(b domain.Book) error {
+	return w.enc.Encode(b)
+}
+
+func (w *ndjsonBookWriter) Close() error {
+	return nil
+}
+
+func (w *ndjsonBookWriter) Abort() {}
+
+// jsonBookWriter writes a JSON array, one element at a time.
+type jsonBookWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (w *jsonBookWriter) Write(b domain.Book) error {
+	sep := ","
+	if !w.started {
+		sep, w.started = "[", true
+	}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w.w, sep); err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(data)
+
+	return err
+}
+
+func (w *jsonBookWriter) Close() error {
+	end := "]"
+	if !w.started {
+		end = "[]"
+	}
+
+	_, err := io.WriteString(w.w, end)
+
+	return err
+}
+
+func (w *jsonBookWriter) Abort() {}
+
+// xlsxBookWriter streams rows to a temporary file kept by excelize; a
+// workbook is a zip archive, so it is only written out on Close.
+type xlsxBookWriter struct {
+	w    io.Writer
+	file *excelize.File
+	sw   *excelize.StreamWriter
+	row  int
+}
+
+func newXLSXBookWriter(w io.Writer) (*xlsxBookWriter, error) {
+	file := excelize.NewFile()
+	if err := file.SetSheetName("Sheet1", exportSheet); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	sw, err := file.NewStreamWriter(exportSheet)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	xw := &xlsxBookWriter{w: w, file: file, sw: sw}
+
+	header := make([]interface{}, len(exportColumns))
+	for i, column := range exportColumns {
+		header[i] = column
+	}
+
+	if err := xw.setRow(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return xw, nil
+}
+
+func (w *xlsxBookWriter) Write(b domain.Book) error {
+	return w.setRow([]interface{}{
+		b.ID, b.Name, b.Description, b.Author, b.IsFree, strings.Join(b.Genres, genresSeparator),
+		b.PublishedAt.UTC(), b.Version,
+	})
+}
+
+func (w *xlsxBookWriter) setRow(values []interface{}) error {
+	w.row++
+
+	cell, err := excelize.CoordinatesToCellName(1, w.row)
+	if err != nil {
+		return err
+	}
+
+	return w.sw.SetRow(cell, values)
+}
+
+func (w *xlsxBookWriter) Close() error {
+	defer w.file.Close()
+
+	if err := w.sw.Flush(); err != nil {
+		return err
+	}
+
+	return w.file.Write(w.w)
+}
+
+func (w *xlsxBookWriter) Abort() {
+	w.file.Close()
+}
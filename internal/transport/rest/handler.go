@@ -2,9 +2,13 @@ package rest
 
 import (
 	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackietana/crud-app/internal/domain"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 
 	_ "github.com/jackietana/crud-app/docs"
 	swaggerFiles "github.com/swaggo/files"
@@ -12,48 +16,146 @@ import (
 )
 
 type BookService interface {
-	CreateBook(ctx context.Context, book domain.Book) error
+	CreateBook(ctx context.Context, book domain.Book) (domain.Book, error)
 	GetBookById(ctx context.Context, id int) (domain.Book, error)
-	GetBooks(ctx context.Context) ([]domain.Book, error)
-	UpdateBook(ctx context.Context, id int, book domain.Book) error
-	DeleteBook(ctx context.Context, id int) error
+	GetBooks(ctx context.Context, q domain.BookQuery) (domain.BookPage, error)
+	ExportBooks(ctx context.Context, q domain.BookQuery, fn func(domain.Book) error) error
+	SearchBooks(ctx context.Context, q domain.BookSearchQuery) (domain.BookSearchPage, error)
+	UpdateBook(ctx context.Context, id int, book domain.Book, version int) (domain.Book, error)
+	PatchBook(ctx context.Context, id, version int, patch func(domain.Book) (domain.Book, error)) (domain.Book, error)
+	DeleteBook(ctx context.Context, id, version int) error
+	PurgeBook(ctx context.Context, id, version int) error
+	RestoreBook(ctx context.Context, id int) (domain.Book, error)
+	GetTrash(ctx context.Context, limit, offset int) (domain.BookPage, error)
+	GetRevisions(ctx context.Context, id, limit, offset int) (domain.BookRevisionPage, error)
+	GetRevision(ctx context.Context, id, rev int) (domain.BookRevision, error)
+	DiffRevisions(ctx context.Context, id, from, to int) (domain.BookDiff, error)
+	RevertBook(ctx context.Context, id, rev, version int) (domain.Book, error)
+	CacheStats(ctx context.Context) domain.CacheStats
+	FlushCache(ctx context.Context) error
+	EvictCachedBook(ctx context.Context, id int)
+}
+
+type BookImporter interface {
+	ImportBooks(ctx context.Context, src domain.BookSource, opts domain.ImportOptions) (domain.ImportResult, error)
+	StartImport(ctx context.Context, src domain.BookSource, opts domain.ImportOptions,
+		release func()) (domain.ImportJob, error)
+	GetImportJob(ctx context.Context, id string) (domain.ImportJob, error)
 }
 
 type UserService interface {
 	SignUp(ctx context.Context, user domain.User) error
-	SignIn(ctx context.Context, user domain.UserSignIn) (string, string, error)
-	ParseToken(ctx context.Context, accessToken string) (int, error)
-	RefreshTokens(ctx context.Context, refreshToken string) (string, string, error)
+	SignIn(ctx context.Context, user domain.UserSignIn, meta domain.SessionMeta) (string, string, error)
+	ParseToken(ctx context.Context, accessToken string) (domain.TokenClaims, error)
+	RefreshTokens(ctx context.Context, refreshToken string, meta domain.SessionMeta) (string, string, error)
+	GetSessions(ctx context.Context, userId, currentSessionId int) ([]domain.Session, error)
+	RevokeSession(ctx context.Context, userId, sessionId int) error
+	Logout(ctx context.Context, claims domain.TokenClaims) error
+	LogoutAll(ctx context.Context, claims domain.TokenClaims) error
+	SetRole(ctx context.Context, userId int, role domain.Role) error
+}
+
+type OutboxService interface {
+	GetStatus(ctx context.Context) (domain.OutboxStatus, error)
+}
+
+const serviceName = "crud-app"
+
+type Metrics interface {
+	ObserveRequest(method, route string, status int, duration time.Duration)
+	Handler() http.Handler
+}
+
+// Options are the handler settings that come from the config.
+type Options struct {
+	// RequireIfMatch rejects book writes without If-Match
+	RequireIfMatch bool
+	// ImportMaxSize caps the size of an import upload, in bytes
+	ImportMaxSize int64
+	// ImportAsyncThreshold is the upload size from which an import runs
+	// as a background job
+	ImportAsyncThreshold int64
 }
 
 type Handler struct {
-	bookService BookService
-	userService UserService
+	bookService   BookService
+	bookImporter  BookImporter
+	userService   UserService
+	outboxService OutboxService
+	metrics       Metrics
+
+	readinessChecks map[string]HealthChecker
+	shuttingDown    atomic.Bool
+
+	opts Options
 }
 
-func NewHandler(bookService BookService, userService UserService) *Handler {
-	return &Handler{bookService, userService}
+func NewHandler(bookService BookService, bookImporter BookImporter, userService UserService,
+	outboxService OutboxService, metrics Metrics, readinessChecks map[string]HealthChecker, opts Options) *Handler {
+	return &Handler{
+		bookService:     bookService,
+		bookImporter:    bookImporter,
+		userService:     userService,
+		outboxService:   outboxService,
+		metrics:         metrics,
+		readinessChecks: readinessChecks,
+		opts:            opts,
+	}
 }
 
 func (h *Handler) InitRouter() *gin.Engine {
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.Logger(), recoveryMiddleware())
+	r.Use(otelgin.Middleware(serviceName, otelgin.WithFilter(func(r *http.Request) bool {
+		return r.URL.Path != "/metrics" && r.URL.Path != "/healthz" && r.URL.Path != "/readyz"
+	})))
 	r.Use(loggerMiddleware())
+	r.Use(h.metricsMiddleware())
+
+	r.GET("/healthz", h.healthz)
+	r.GET("/readyz", h.readyz)
+	r.GET("/metrics", gin.WrapH(h.metrics.Handler()))
 
 	{
 		auth := r.Group("/auth")
 		auth.POST("/sign-up", h.signUp)
 		auth.GET("/sign-in", h.signIn)
 		auth.GET("/refresh", h.refresh)
+		auth.POST("/logout", h.authMiddleware(), h.logout)
+		auth.POST("/logout-all", h.authMiddleware(), h.logoutAll)
+		auth.GET("/sessions", h.authMiddleware(), h.getSessions)
+		auth.DELETE("/sessions/:id", h.authMiddleware(), h.deleteSession)
 	}
 
 	{
 		books := r.Group("/books")
 		books.Use(h.authMiddleware())
-		books.POST("", h.createBook)
+		books.POST("", h.requireRole(domain.RoleEditor), h.createBook)
+		books.GET("/search", h.searchBooks)
+		books.GET("/export", h.exportBooks)
+		books.GET("/trash", h.requireRole(domain.RoleAdmin), h.getTrash)
+		books.POST("/import", h.requireRole(domain.RoleEditor), h.importBooks)
+		books.GET("/import/:job", h.requireRole(domain.RoleEditor), h.getImportJob)
+		books.POST("/:id/restore", h.requireRole(domain.RoleAdmin), h.restoreBook)
 		books.GET("/:id", h.getBookById)
 		books.GET("", h.getBooks)
-		books.PUT("/:id", h.updateBook)
-		books.DELETE("/:id", h.deleteBook)
+		books.PUT("/:id", h.requireRole(domain.RoleEditor), h.updateBook)
+		books.PATCH("/:id", h.requireRole(domain.RoleEditor), h.patchBook)
+		books.DELETE("/:id", h.requireRole(domain.RoleEditor), h.deleteBook)
+		books.GET("/:id/revisions", h.requireRole(domain.RoleEditor), h.getRevisions)
+		books.GET("/:id/revisions/diff", h.requireRole(domain.RoleEditor), h.diffRevisions)
+		books.GET("/:id/revisions/:rev", h.requireRole(domain.RoleEditor), h.getRevision)
+		books.POST("/:id/revisions/:rev/revert", h.requireRole(domain.RoleEditor), h.revertBook)
+	}
+
+	{
+		admin := r.Group("/admin")
+		admin.Use(h.authMiddleware(), h.requireRole(domain.RoleAdmin))
+		admin.PUT("/users/:id/role", h.setUserRole)
+		admin.GET("/outbox", h.getOutboxStatus)
+		admin.GET("/cache", h.getCacheStats)
+		admin.DELETE("/cache", h.flushCache)
+		admin.DELETE("/cache/books/:id", h.evictCachedBook)
 	}
 
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
@@ -0,0 +1,84 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+// HealthChecker reports whether a dependency the service needs is usable.
+type HealthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// HealthCheckFunc adapts a function to HealthChecker.
+type HealthCheckFunc func(ctx context.Context) error
+
+func (f HealthCheckFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// MarkShuttingDown makes /readyz fail, so load balancers stop routing
+// new requests while in-flight ones are drained.
+func (h *Handler) MarkShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// @Summary Liveness probe
+// @Tags health
+// @Produce plain
+// @Success 200 {string} string "ok"
+// @Router /healthz [get]
+func (h *Handler) healthz(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+// @Summary Readiness probe
+// @Description checks postgres and the gRPC logger connection
+// @Tags health
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 503 {object} map[string]interface{}
+// @Router /readyz [get]
+func (h *Handler) readyz(c *gin.Context) {
+	status := http.StatusOK
+	checks := make(map[string]string, len(h.readinessChecks))
+
+	if h.shuttingDown.Load() {
+		status = http.StatusServiceUnavailable
+		checks["server"] = "shutting down"
+	}
+
+	for name, checker := range h.readinessChecks {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessCheckTimeout)
+		err := checker.Check(ctx)
+		cancel()
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"handler": "readyz",
+				"check":   name,
+			}).Error(err)
+			status = http.StatusServiceUnavailable
+			checks[name] = err.Error()
+			continue
+		}
+
+		checks[name] = "ok"
+	}
+
+	result := "ok"
+	if status != http.StatusOK {
+		result = "unavailable"
+	}
+
+	c.JSON(status, gin.H{
+		"status": result,
+		"checks": checks,
+	})
+}
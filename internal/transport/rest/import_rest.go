@@ -0,0 +1,459 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackietana/crud-app/internal/domain"
+	log "github.com/sirupsen/logrus"
+)
+
+// @Summary Import books
+// @Description load books from a CSV, JSON array or NDJSON file in one transaction; rows that fail validation are reported and skipped
+// @Tags books
+// @Accept text/csv,application/json,application/x-ndjson,multipart/form-data
+// @Produce json
+// @Param file formData file false "Import file, when sent as multipart/form-data"
+// @Param format query string false "csv, json or ndjson, by default taken from the content type or file name"
+// @Param mode query string false "insert (default) or upsert by name and author"
+// @Param dry_run query bool false "Validate and roll back"
+// @Param async query bool false "Run as a background job, large uploads always do"
+// @Security TokenAuth
+// @Success 200 {object} domain.ImportResult
+// @Success 202 {object} domain.ImportJob
+// @Header 202 {string} Location "import job status"
+// @Failure 400 {string} string "invalid import"
+// @Failure 403 {string} string "forbidden"
+// @Failure 413 {string} string "import is too large"
+// @Router /books/import [post]
+func (h *Handler) importBooks(c *gin.Context) {
+	opts := domain.ImportOptions{Mode: c.Query("mode")}
+
+	dryRun, errDryRun := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	async, errAsync := strconv.ParseBool(c.DefaultQuery("async", "false"))
+	if err := errors.Join(errDryRun, errAsync, opts.Normalize()); err != nil {
+		log.WithFields(log.Fields{
+			"handler": "importBooks",
+			"issue":   "query error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.DryRun = dryRun
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.opts.ImportMaxSize)
+
+	body, contentType, fileName, err := importUpload(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "importBooks",
+			"issue":   "upload error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), importStatus(err))
+		return
+	}
+
+	format, err := importFormat(c.Query("format"), contentType, fileName)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "importBooks",
+			"issue":   "format error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// a chunked upload has no length and may be large, it runs in the background
+	if async || c.Request.ContentLength < 0 || c.Request.ContentLength > h.opts.ImportAsyncThreshold {
+		h.startImport(c, body, format, opts)
+		return
+	}
+
+	src, err := newBookSource(format, body)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "importBooks",
+			"issue":   "source error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), importStatus(err))
+		return
+	}
+
+	result, err := h.bookImporter.ImportBooks(c.Request.Context(), src, opts)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "importBooks",
+			"issue":   "service error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), importStatus(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	log.WithFields(log.Fields{
+		"inserted": result.Inserted,
+		"updated":  result.Updated,
+		"failed":   result.Failed,
+		"dry_run":  result.DryRun,
+	}).Info("Handler: importBooks")
+}
+
+// startImport spools the upload to a temporary file, so the request can
+// end, and imports it in the background.
+func (h *Handler) startImport(c *gin.Context, body io.Reader, format string, opts domain.ImportOptions) {
+	f, err := os.CreateTemp("", "books-import-*")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "importBooks",
+			"issue":   "spool error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	release := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if _, err := io.Copy(f, body); err != nil {
+		release()
+		log.WithFields(log.Fields{
+			"handler": "importBooks",
+			"issue":   "spool error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), importStatus(err))
+		return
+	}
+
+	src, err := func() (domain.BookSource, error) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		return newBookSource(format, f)
+	}()
+	if err != nil {
+		release()
+		log.WithFields(log.Fields{
+			"handler": "importBooks",
+			"issue":   "source error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), importStatus(err))
+		return
+	}
+
+	job, err := h.bookImporter.StartImport(c.Request.Context(), src, opts, release)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "importBooks",
+			"issue":   "service error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), importStatus(err))
+		return
+	}
+
+	c.Header("Location", "/books/import/"+job.ID)
+	c.JSON(http.StatusAccepted, job)
+	log.WithField("job", job.ID).Info("Handler: importBooks")
+}
+
+// @Summary Import job status
+// @Description get the progress or the result of a background import; jobs are known to the instance running them
+// @Tags books
+// @Produce json
+// @Param job path string true "Import job ID"
+// @Security TokenAuth
+// @Success 200 {object} domain.ImportJob
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "import job not found"
+// @Router /books/import/{job} [get]
+func (h *Handler) getImportJob(c *gin.Context) {
+	job, err := h.bookImporter.GetImportJob(c.Request.Context(), c.Param("job"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "getImportJob",
+			"issue":   "service error",
+		}).Error(err)
+
+		if errors.Is(err, domain.ErrImportJobNotFound) {
+			http.Error(c.Writer, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+	log.WithFields(log.Fields{"job": job.ID, "status": job.Status}).Info("Handler: getImportJob")
+}
+
+// importUpload returns the import file: the file part of a multipart
+// form or else the request body.
+func importUpload(c *gin.Context) (io.Reader, string, string, error) {
+	if c.ContentType() != "multipart/form-data" {
+		return c.Request.Body, c.ContentType(), "", nil
+	}
+
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("%w: %w", domain.ErrInvalidImport, err)
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, "", "", fmt.Errorf("%w: the form has no file field", domain.ErrInvalidImport)
+		} else if err != nil {
+			return nil, "", "", fmt.Errorf("%w: %w", domain.ErrInvalidImport, err)
+		}
+
+		if part.FormName() != "file" {
+			continue
+		}
+
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+
+		return part, contentType, part.FileName(), nil
+	}
+}
+
+func importStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, domain.ErrInvalidImport):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+const (
+	importFormatCSV    = "csv"
+	importFormatJSON   = "json"
+	importFormatNDJSON = "ndjson"
+
+	// genresSeparator joins the genres of a book in a CSV cell
+	genresSeparator = "|"
+
+	maxNDJSONLine = 1 << 20
+)
+
+// importFormat picks the format from the query, else from the content
+// type or the file name of the upload.
+func importFormat(query, contentType, fileName string) (string, error) {
+	format := query
+	if format == "" {
+		switch contentType {
+		case "text/csv":
+			format = importFormatCSV
+		case "application/json":
+			format = importFormatJSON
+		case "application/x-ndjson", "application/jsonl":
+			format = importFormatNDJSON
+		default:
+			format = strings.TrimPrefix(strings.ToLower(filepath.Ext(fileName)), ".")
+			if format == "jsonl" {
+				format = importFormatNDJSON
+			}
+		}
+	}
+
+	switch format {
+	case importFormatCSV, importFormatJSON, importFormatNDJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("%w: format must be %s, %s or %s", domain.ErrInvalidImport,
+			importFormatCSV, importFormatJSON, importFormatNDJSON)
+	}
+}
+
+func newBookSource(format string, r io.Reader) (domain.BookSource, error) {
+	switch format {
+	case importFormatCSV:
+		return newCSVSource(r)
+	case importFormatJSON:
+		return newJSONSource(r)
+	default:
+		return newNDJSONSource(r), nil
+	}
+}
+
+// csvSource reads a CSV file with a header row. It needs the name,
+// description, author and genres columns, is_free is optional and other
+// columns, such as those of an export, are ignored. Genres are separated
+// by |.
+type csvSource struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func newCSVSource(r io.Reader) (*csvSource, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: csv header: %w", domain.ErrInvalidImport, err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for _, name := range []string{"name", "description", "author", "genres"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%w: csv header has no %s column", domain.ErrInvalidImport, name)
+		}
+	}
+
+	cr.FieldsPerRecord = len(header)
+
+	return &csvSource{r: cr, columns: columns}, nil
+}
+
+func (s *csvSource) Next() (domain.ImportRow, error) {
+	record, err := s.r.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return domain.ImportRow{Line: parseErr.StartLine, Err: parseErr.Err}, nil
+		}
+
+		return domain.ImportRow{}, err
+	}
+
+	line, _ := s.r.FieldPos(0)
+	row := domain.ImportRow{Line: line}
+
+	field := func(name string) string {
+		if i, ok := s.columns[name]; ok {
+			return strings.TrimSpace(record[i])
+		}
+
+		return ""
+	}
+
+	row.Book = domain.Book{
+		Name:        field("name"),
+		Description: field("description"),
+		Author:      field("author"),
+		Genres:      make([]string, 0),
+	}
+
+	for _, genre := range strings.Split(field("genres"), genresSeparator) {
+		if genre = strings.TrimSpace(genre); genre != "" {
+			row.Book.Genres = append(row.Book.Genres, genre)
+		}
+	}
+
+	if v := field("is_free"); v != "" {
+		if row.Book.IsFree, err = strconv.ParseBool(v); err != nil {
+			row.Err = fmt.Errorf("is_free: %q is not a boolean", v)
+		}
+	}
+
+	return row, nil
+}
+
+// jsonSource reads a JSON array of books one element at a time.
+type jsonSource struct {
+	dec  *json.Decoder
+	line int
+}
+
+func newJSONSource(r io.Reader) (*jsonSource, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("%w: json import must be an array of books", domain.ErrInvalidImport)
+	}
+
+	return &jsonSource{dec: dec}, nil
+}
+
+func (s *jsonSource) Next() (domain.ImportRow, error) {
+	if !s.dec.More() {
+		if _, err := s.dec.Token(); err != nil {
+			return domain.ImportRow{}, fmt.Errorf("%w: %w", domain.ErrInvalidImport, err)
+		}
+
+		return domain.ImportRow{}, io.EOF
+	}
+
+	s.line++
+	row := domain.ImportRow{Line: s.line}
+
+	if err := s.dec.Decode(&row.Book); err != nil {
+		// a value of the wrong type is skipped, broken JSON ends the import
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) || strings.HasPrefix(err.Error(), "json: unknown field") {
+			row.Err = err
+			return row, nil
+		}
+
+		return row, fmt.Errorf("%w: element %d: %w", domain.ErrInvalidImport, s.line, err)
+	}
+
+	return row, nil
+}
+
+// ndjsonSource reads a book per line, skipping blank lines.
+type ndjsonSource struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONSource(r io.Reader) *ndjsonSource {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxNDJSONLine)
+
+	return &ndjsonSource{scanner: scanner}
+}
+
+func (s *ndjsonSource) Next() (domain.ImportRow, error) {
+	for s.scanner.Scan() {
+		s.line++
+
+		data := bytes.TrimSpace(s.scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		row := domain.ImportRow{Line: s.line}
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&row.Book); err != nil {
+			row.Err = err
+		} else if dec.More() {
+			row.Err = errors.New("more than one value on the line")
+		}
+
+		return row, nil
+	}
+
+	if err := s.scanner.Err(); err != nil {
+		return domain.ImportRow{}, fmt.Errorf("%w: line %d: %w", domain.ErrInvalidImport, s.line+1, err)
+	}
+
+	return domain.ImportRow{}, io.EOF
+}
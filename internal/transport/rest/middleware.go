@@ -3,13 +3,43 @@ package rest
 import (
 	"errors"
 	"net/http"
+	"runtime/debug"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackietana/crud-app/internal/domain"
 	log "github.com/sirupsen/logrus"
 )
 
+// recoveryMiddleware answers 500 to a handler that panics, as
+// gin.Recovery does, but passes http.ErrAbortHandler on to net/http. A
+// handler panics with it to reset the connection when a response already
+// under way fails, so the client cannot take it for a complete one.
+func recoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			log.WithFields(log.Fields{
+				"method": c.Request.Method,
+				"URL":    c.Request.URL,
+				"stack":  string(debug.Stack()),
+			}).Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}()
+
+		c.Next()
+	}
+}
+
 func loggerMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		startTime := time.Now()
@@ -24,6 +54,22 @@ func loggerMiddleware() gin.HandlerFunc {
 	}
 }
 
+// metricsMiddleware records request count and latency. Requests are labeled
+// with the route template, so /books/1 and /books/2 share a series.
+func (h *Handler) metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		startTime := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		h.metrics.ObserveRequest(c.Request.Method, route, c.Writer.Status(), time.Since(startTime))
+	}
+}
+
 func (h *Handler) authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token, err := getTokenFromRequest(c.Request)
@@ -34,19 +80,54 @@ func (h *Handler) authMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		userId, err := h.userService.ParseToken(c.Request.Context(), token)
+		claims, err := h.userService.ParseToken(c.Request.Context(), token)
 		if err != nil {
 			log.WithField("middleware:", "authMiddleware").Error(err)
-			http.Error(c.Writer, err.Error(), http.StatusUnauthorized)
+			if errors.Is(err, domain.ErrTokenCheckFailed) {
+				http.Error(c.Writer, domain.ErrTokenCheckFailed.Error(), http.StatusInternalServerError)
+			} else {
+				http.Error(c.Writer, err.Error(), http.StatusUnauthorized)
+			}
 			c.Abort()
 			return
 		}
 
-		c.Set("userId", userId)
+		c.Request = c.Request.WithContext(domain.WithUserID(c.Request.Context(), claims.UserID))
+		c.Set("claims", claims)
+		c.Set("userId", claims.UserID)
+		c.Set("role", claims.Role)
+		c.Set("sessionId", claims.SessionID)
 		c.Next()
 	}
 }
 
+// requireRole lets the request through only if the role set by
+// authMiddleware includes the given one.
+func (h *Handler) requireRole(role domain.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userRole, _ := c.Get("role")
+		if !hasRole(userRole, role) {
+			log.WithFields(log.Fields{
+				"middleware:": "requireRole",
+				"required":    role,
+				"role":        userRole,
+			}).Error(domain.ErrForbidden)
+			http.Error(c.Writer, domain.ErrForbidden.Error(), http.StatusForbidden)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// hasRole reports whether the role set by authMiddleware includes role.
+func hasRole(userRole interface{}, role domain.Role) bool {
+	r, ok := userRole.(domain.Role)
+
+	return ok && r.Includes(role)
+}
+
 func getTokenFromRequest(r *http.Request) (string, error) {
 	header := r.Header.Get("Authorization")
 	if header == "" {
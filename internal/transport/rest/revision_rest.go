@@ -0,0 +1,224 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackietana/crud-app/internal/domain"
+	log "github.com/sirupsen/logrus"
+)
+
+// @Summary List book revisions
+// @Description get the revisions of a book, newest first; revisions outlive purged books
+// @Tags revisions
+// @Produce json
+// @Param id path int true "Book ID"
+// @Param limit query int false "Page size (max 100)"
+// @Param offset query int false "Number of revisions to skip"
+// @Security TokenAuth
+// @Success 200 {object} domain.BookRevisionPage
+// @Failure 400 {string} string "invalid book query"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "book not found"
+// @Router /books/{id}/revisions [get]
+func (h *Handler) getRevisions(c *gin.Context) {
+	id, err := getId(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "getRevisions",
+			"issue":   "getId error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, offset, err := getPagination(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "getRevisions",
+			"issue":   "query error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.bookService.GetRevisions(c.Request.Context(), id, limit, offset)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "getRevisions",
+			"issue":   "service error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), revisionStatus(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+	log.WithFields(log.Fields{"id": id, "count": len(page.Revisions)}).Info("Handler: getRevisions")
+}
+
+// @Summary Get book revision
+// @Description get a snapshot of a book as one of its writes left it
+// @Tags revisions
+// @Produce json
+// @Param id path int true "Book ID"
+// @Param rev path int true "Revision"
+// @Security TokenAuth
+// @Success 200 {object} domain.BookRevision
+// @Failure 400 {string} string "invalid revision"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "revision not found"
+// @Router /books/{id}/revisions/{rev} [get]
+func (h *Handler) getRevision(c *gin.Context) {
+	id, rev, err := getRevisionParams(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "getRevision",
+			"issue":   "params error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r, err := h.bookService.GetRevision(c.Request.Context(), id, rev)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "getRevision",
+			"issue":   "service error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), revisionStatus(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, r)
+	log.WithFields(log.Fields{"id": id, "revision": rev}).Info("Handler: getRevision")
+}
+
+// @Summary Diff book revisions
+// @Description list the fields changed from one revision of a book to another
+// @Tags revisions
+// @Produce json
+// @Param id path int true "Book ID"
+// @Param from query int true "Revision to diff from"
+// @Param to query int true "Revision to diff to"
+// @Security TokenAuth
+// @Success 200 {object} domain.BookDiff
+// @Failure 400 {string} string "from and to revisions are required"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "revision not found"
+// @Router /books/{id}/revisions/diff [get]
+func (h *Handler) diffRevisions(c *gin.Context) {
+	id, err := getId(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "diffRevisions",
+			"issue":   "getId error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, errFrom := strconv.Atoi(c.Query("from"))
+	to, errTo := strconv.Atoi(c.Query("to"))
+	if err := errors.Join(errFrom, errTo); err != nil {
+		log.WithFields(log.Fields{
+			"handler": "diffRevisions",
+			"issue":   "query error",
+		}).Error(err)
+		http.Error(c.Writer, "from and to revisions are required", http.StatusBadRequest)
+		return
+	}
+
+	diff, err := h.bookService.DiffRevisions(c.Request.Context(), id, from, to)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "diffRevisions",
+			"issue":   "service error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), revisionStatus(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, diff)
+	log.WithFields(log.Fields{"id": id, "from": from, "to": to}).Info("Handler: diffRevisions")
+}
+
+// @Summary Revert book
+// @Description put the fields of a revision back into the book, as a new revision
+// @Tags revisions
+// @Produce json
+// @Param id path int true "Book ID"
+// @Param rev path int true "Revision to revert to"
+// @Param If-Match header string false "ETag of the book being reverted"
+// @Security TokenAuth
+// @Success 200 {object} domain.Book
+// @Header 200 {string} ETag "new book version"
+// @Failure 400 {string} string "invalid revision"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "book or revision not found"
+// @Failure 412 {string} string "ETag does not match"
+// @Failure 428 {string} string "If-Match required"
+// @Router /books/{id}/revisions/{rev}/revert [post]
+func (h *Handler) revertBook(c *gin.Context) {
+	id, rev, err := getRevisionParams(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "revertBook",
+			"issue":   "params error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := h.ifMatchVersion(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "revertBook",
+			"issue":   "precondition error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), writeStatus(err))
+		return
+	}
+
+	book, err := h.bookService.RevertBook(c.Request.Context(), id, rev, version)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "revertBook",
+			"issue":   "service error",
+		}).Error(err)
+
+		if errors.Is(err, domain.ErrRevisionNotFound) {
+			http.Error(c.Writer, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(c.Writer, err.Error(), writeStatus(err))
+		}
+		return
+	}
+
+	c.Header("ETag", bookETag(book))
+	c.JSON(http.StatusOK, book)
+	log.WithFields(log.Fields{"id": id, "revision": rev}).Info("Handler: revertBook")
+}
+
+func getRevisionParams(c *gin.Context) (int, int, error) {
+	id, err := getId(c)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rev, err := strconv.Atoi(c.Param("rev"))
+
+	return id, rev, err
+}
+
+func revisionStatus(err error) int {
+	switch {
+	case errors.Is(err, domain.ErrBookNotFound), errors.Is(err, domain.ErrRevisionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, domain.ErrInvalidBookQuery):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,97 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackietana/crud-app/internal/domain"
+	log "github.com/sirupsen/logrus"
+)
+
+// @Summary List trash
+// @Description get deleted books not purged yet, most recently deleted first
+// @Tags books
+// @Produce json
+// @Param limit query int false "Page size (max 100)"
+// @Param offset query int false "Number of books to skip"
+// @Security TokenAuth
+// @Success 200 {object} domain.BookPage
+// @Failure 400 {string} string "invalid book query"
+// @Failure 403 {string} string "forbidden"
+// @Router /books/trash [get]
+func (h *Handler) getTrash(c *gin.Context) {
+	limit, offset, err := getPagination(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "getTrash",
+			"issue":   "query error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.bookService.GetTrash(c.Request.Context(), limit, offset)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "getTrash",
+			"issue":   "service error",
+		}).Error(err)
+
+		if errors.Is(err, domain.ErrInvalidBookQuery) {
+			http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+	log.WithField("count", len(page.Books)).Info("Handler: getTrash")
+}
+
+// @Summary Restore book
+// @Description take a deleted book out of the trash
+// @Tags books
+// @Produce json
+// @Param id path int true "Book ID"
+// @Security TokenAuth
+// @Success 200 {object} domain.Book
+// @Header 200 {string} ETag "new book version"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "book not found"
+// @Failure 409 {string} string "book is not in the trash"
+// @Router /books/{id}/restore [post]
+func (h *Handler) restoreBook(c *gin.Context) {
+	id, err := getId(c)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "restoreBook",
+			"issue":   "getId error",
+		}).Error(err)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	book, err := h.bookService.RestoreBook(c.Request.Context(), id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"handler": "restoreBook",
+			"issue":   "service error",
+		}).Error(err)
+
+		switch {
+		case errors.Is(err, domain.ErrBookNotFound):
+			http.Error(c.Writer, err.Error(), http.StatusNotFound)
+		case errors.Is(err, domain.ErrBookNotInTrash):
+			http.Error(c.Writer, err.Error(), http.StatusConflict)
+		default:
+			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.Header("ETag", bookETag(book))
+	c.JSON(http.StatusOK, book)
+	log.WithField("id", id).Info("Handler: restoreBook")
+}
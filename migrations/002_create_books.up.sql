@@ -1,6 +1,4 @@
-DROP TABLE IF EXISTS books;
-
-CREATE TABLE books (
+CREATE TABLE IF NOT EXISTS books (
     id SERIAL NOT NULL UNIQUE,
     name VARCHAR(255) NOT NULL,
     description VARCHAR(255) NOT NULL,
@@ -1,4 +1,5 @@
 DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS sessions;
 
 CREATE TABLE refresh_tokens (
     id SERIAL NOT NULL UNIQUE,
@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id SERIAL NOT NULL UNIQUE,
+    user_id INT REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+
+-- refresh tokens now belong to a session and are stored hashed; tokens
+-- of the old table cannot be carried over, their users sign in again
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                   WHERE table_name = 'refresh_tokens' AND column_name = 'session_id') THEN
+        DROP TABLE IF EXISTS refresh_tokens;
+    END IF;
+END;
+$$;
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id SERIAL NOT NULL UNIQUE,
+    session_id INT REFERENCES sessions (id) ON DELETE CASCADE NOT NULL,
+    user_id INT REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS token_denylist (
+    key VARCHAR(64) NOT NULL PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS token_denylist_expires_at_idx ON token_denylist (expires_at);
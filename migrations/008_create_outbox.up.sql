@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL NOT NULL PRIMARY KEY,
+    entity VARCHAR(32) NOT NULL,
+    action VARCHAR(32) NOT NULL,
+    entity_id BIGINT NOT NULL,
+    actor_id INT,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    locked_until TIMESTAMP,
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE sent_at IS NULL;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS book_revisions;
+
+DROP FUNCTION IF EXISTS book_revisions_immutable();
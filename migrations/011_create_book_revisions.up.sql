@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS book_revisions (
+    book_id INT NOT NULL,
+    revision INT NOT NULL,
+    action VARCHAR(16) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    author VARCHAR(255) NOT NULL,
+    is_free BOOLEAN NOT NULL,
+    genres TEXT[] NOT NULL,
+    published_at TIMESTAMP NOT NULL,
+    deleted_at TIMESTAMP,
+    actor_id INT,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (book_id, revision)
+);
+
+-- existing books start their history at their current state
+INSERT INTO book_revisions (book_id, revision, action, name, description, author, is_free, genres, published_at, deleted_at)
+SELECT id, version, CASE WHEN deleted_at IS NULL THEN 'created' ELSE 'deleted' END,
+    name, description, author, is_free, genres, published_at, deleted_at
+FROM books
+ON CONFLICT DO NOTHING;
+
+-- revisions are immutable: they are only ever inserted
+CREATE OR REPLACE FUNCTION book_revisions_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'book revisions are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS book_revisions_immutable ON book_revisions;
+
+CREATE TRIGGER book_revisions_immutable
+    BEFORE UPDATE OR DELETE ON book_revisions
+    FOR EACH ROW EXECUTE FUNCTION book_revisions_immutable();
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS books_natural_key_idx;
@@ -0,0 +1,2 @@
+-- imports upsert books by name and author
+CREATE INDEX IF NOT EXISTS books_natural_key_idx ON books (LOWER(name), LOWER(author)) WHERE deleted_at IS NULL;
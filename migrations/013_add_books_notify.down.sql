@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS books_notify ON books;
+
+DROP FUNCTION IF EXISTS books_notify();
@@ -0,0 +1,22 @@
+-- every committed change to a book is announced on the books_changed
+-- channel, so each instance can drop its cached copy
+CREATE OR REPLACE FUNCTION books_notify() RETURNS trigger AS $$
+DECLARE
+    book_id INT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        book_id := OLD.id;
+    ELSE
+        book_id := NEW.id;
+    END IF;
+
+    PERFORM pg_notify('books_changed', json_build_object('id', book_id, 'op', lower(TG_OP))::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS books_notify ON books;
+
+CREATE TRIGGER books_notify
+    AFTER INSERT OR UPDATE OR DELETE ON books
+    FOR EACH ROW EXECUTE FUNCTION books_notify();
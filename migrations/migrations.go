@@ -0,0 +1,11 @@
+// Package migrations embeds the database migrations. Each version has an
+// up and a down file, named <version>_<name>.up.sql and .down.sql.
+//
+// Up migrations skip what already exists, so a database set up before
+// migrations were tracked is adopted by running them.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
@@ -1,109 +1,337 @@
 package cache
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
-	"github.com/jackietana/cache-example"
 	"github.com/jackietana/crud-app/internal/domain"
 	log "github.com/sirupsen/logrus"
 )
 
-const cacheTTL = time.Hour * 8
+const (
+	kindBook  = "book"
+	kindQuery = "books_query"
 
-var (
-	allBooksCached bool
-	cachedBookIDs  = make(map[string]string, 0)
+	evictionInvalidated = "invalidated"
+	evictionExpired     = "expired"
+	evictionCapacity    = "capacity"
+	evictionFlushed     = "flushed"
 )
 
+// ErrNotCached is returned, wrapped, by lookups that miss.
+var ErrNotCached = errors.New("not cached")
+
+// Metrics receives cache hit, miss and eviction events.
+type Metrics interface {
+	CacheHit(kind string)
+	CacheMiss(kind string)
+	CacheEviction(reason string)
+}
+
+type MemoryConfig struct {
+	BookTTL time.Duration
+	ListTTL time.Duration
+	// Policy is PolicyLRU or PolicyLFU
+	Policy string
+	// MaxEntries and MaxBytes bound the cache, 0 means no bound. Sizes
+	// are estimated from the book fields.
+	MaxEntries int
+	MaxBytes   int64
+}
+
+// CacheHandler keeps books in the memory of this instance. It is safe for
+// concurrent use. A listing is cached as the page the database returned
+// for its normalized query, so the order of the books is kept.
+//
+// When a bound is reached, entries are evicted by the configured policy.
+// Books and listings share the bounds.
 type CacheHandler struct {
-	cache *cache.Cache
+	mu      sync.Mutex
+	books   map[int]*entry
+	queries map[string]*entry
+	policy  evictionPolicy
+	size    int64
+
+	cfg      MemoryConfig
+	counters *counters
 }
 
-func NewCacheHandler() *CacheHandler {
-	return &CacheHandler{cache.New()}
+// entry is a cached book, or a listing when query is set.
+type entry struct {
+	id    int
+	query string
+	book  domain.Book
+	page  domain.BookPage
+
+	size      int64
+	expiresAt time.Time
+
+	// bookkeeping of the eviction policy
+	elem    *list.Element
+	index   int
+	uses    uint64
+	lastUse uint64
 }
 
-func (ch *CacheHandler) GetCachedBooks() ([]domain.Book, error) {
-	var books = make([]domain.Book, 0)
+func NewCacheHandler(cfg MemoryConfig, metrics Metrics) (*CacheHandler, error) {
+	policy, err := newEvictionPolicy(cfg.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CacheHandler{
+		books:    make(map[int]*entry),
+		queries:  make(map[string]*entry),
+		policy:   policy,
+		cfg:      cfg,
+		counters: newCounters(metrics),
+	}, nil
+}
 
-	if allBooksCached {
-		for _, id := range cachedBookIDs {
-			if id != "" {
-				item, err := ch.cache.Get(id)
-				if err != nil {
-					return nil, err
-				}
+// GetCachedBooks returns generation 0: the memory cache is invalidated
+// only through this instance, which keeps fills that raced a write out
+// itself, so it has no generation to check.
+func (ch *CacheHandler) GetCachedBooks(_ context.Context, q domain.BookQuery) (domain.BookPage, int64, error) {
+	queryID := q.CacheKey()
 
-				if book, ok := item.(domain.Book); ok {
-					books = append(books, book)
-				}
-			}
-		}
+	ch.mu.Lock()
+	e, ok := ch.lookup(ch.queries[queryID])
+	ch.mu.Unlock()
 
-		log.Info("Cacher: GetCachedBooks")
-		return books, nil
+	if !ok {
+		ch.counters.CacheMiss(kindQuery)
+		return domain.BookPage{}, 0, fmt.Errorf("%s: %w", queryID, ErrNotCached)
 	}
 
-	return nil, errors.New("not all books are in cache")
+	ch.counters.CacheHit(kindQuery)
+	log.WithField("query", queryID).Info("Cacher: GetCachedBooks")
+
+	return e.page, 0, nil
 }
 
-func (ch *CacheHandler) AddBook(book domain.Book) {
-	bookID := fmt.Sprintf("book_%d", book.ID)
+// AddBook caches the book unless it is in the trash or already cached.
+func (ch *CacheHandler) AddBook(_ context.Context, _ int64, book domain.Book) {
+	ch.mu.Lock()
+	added := ch.addBook(book, time.Now())
+	ch.mu.Unlock()
 
-	if item, _ := ch.cache.Get(bookID); item == nil {
-		ch.cache.Set(bookID, book, cacheTTL)
-		cachedBookIDs[bookID] = bookID
+	if added {
 		log.WithField("id", book.ID).Info("Cacher: AddBook")
 	}
 }
 
-func (ch *CacheHandler) AddBooks(books []domain.Book) {
-	for _, book := range books {
-		ch.AddBook(book)
+func (ch *CacheHandler) AddBooks(_ context.Context, q domain.BookQuery, _ int64, page domain.BookPage) {
+	now := time.Now()
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	for _, book := range page.Books {
+		ch.addBook(book, now)
+	}
+
+	queryID := q.CacheKey()
+	if old, ok := ch.queries[queryID]; ok {
+		ch.remove(old, "")
 	}
 
-	allBooksCached = true
+	ch.add(&entry{query: queryID, page: page, size: pageSize(page), expiresAt: now.Add(ch.cfg.ListTTL)})
 }
 
-func (ch CacheHandler) GetCachedBook(id int) (domain.Book, error) {
-	bookID := fmt.Sprintf("book_%d", id)
+func (ch *CacheHandler) GetCachedBook(_ context.Context, id int) (domain.Book, int64, error) {
+	ch.mu.Lock()
+	e, ok := ch.lookup(ch.books[id])
+	ch.mu.Unlock()
 
-	if val, err := ch.cache.Get(bookID); err == nil {
-		if book, ok := val.(domain.Book); ok {
-			log.WithField("id", id).Info("Cacher: GetCachedBook")
-			return book, nil
-		}
+	if !ok {
+		ch.counters.CacheMiss(kindBook)
+		return domain.Book{}, 0, fmt.Errorf("book_%d: %w", id, ErrNotCached)
 	}
 
-	return domain.Book{}, errors.New(bookID + "not found")
+	ch.counters.CacheHit(kindBook)
+	log.WithField("id", id).Info("Cacher: GetCachedBook")
+
+	return e.book, 0, nil
 }
 
-func (ch *CacheHandler) DeleteCachedBook(id int) {
-	bookId := fmt.Sprintf("book_%d", id)
+func (ch *CacheHandler) DeleteCachedBook(_ context.Context, id int) {
+	ch.mu.Lock()
+	e, ok := ch.books[id]
+	if ok {
+		ch.remove(e, evictionInvalidated)
+	}
+	ch.mu.Unlock()
 
-	if _, err := ch.cache.Get(bookId); err == nil {
-		ch.cache.Delete(bookId)
-		delete(cachedBookIDs, bookId)
+	if ok {
 		log.WithField("id", id).Info("Cacher: DeleteCachedBook")
 	}
 }
 
-func (ch *CacheHandler) UpdateCachedBook(id int, book domain.Book) {
-	bookId := fmt.Sprintf("book_%d", id)
+// UpdateCachedBook replaces a cached book, it does not cache one that is
+// not cached yet. A book moved to the trash is dropped instead.
+func (ch *CacheHandler) UpdateCachedBook(ctx context.Context, id int, book domain.Book) {
+	if book.DeletedAt != nil {
+		ch.DeleteCachedBook(ctx, id)
+		return
+	}
+
+	ch.mu.Lock()
+	old, ok := ch.books[id]
+	if ok {
+		ch.remove(old, "")
+		ch.add(&entry{id: id, book: book, size: bookSize(book), expiresAt: time.Now().Add(ch.cfg.BookTTL)})
+	}
+	ch.mu.Unlock()
+
+	if ok {
+		log.WithField("id", id).Info("Cacher: UpdateCachedBook")
+	}
+}
+
+// UpdateCacher drops every cached listing, since any write may change
+// which books a query returns and in what order.
+func (ch *CacheHandler) UpdateCacher(_ context.Context) {
+	ch.mu.Lock()
+	for _, e := range ch.queries {
+		ch.remove(e, evictionInvalidated)
+	}
+	ch.mu.Unlock()
+}
+
+// Flush drops every cached book and listing.
+func (ch *CacheHandler) Flush(_ context.Context) error {
+	ch.mu.Lock()
+	for _, e := range ch.books {
+		ch.remove(e, evictionFlushed)
+	}
+	for _, e := range ch.queries {
+		ch.remove(e, evictionFlushed)
+	}
+	ch.mu.Unlock()
+
+	log.Info("Cacher: Flush")
+
+	return nil
+}
+
+func (ch *CacheHandler) Stats(_ context.Context) domain.CacheStats {
+	stats := ch.counters.stats("memory")
+	stats.Policy = ch.cfg.Policy
+	stats.MaxEntries = ch.cfg.MaxEntries
+	stats.MaxBytes = ch.cfg.MaxBytes
+
+	ch.mu.Lock()
+	stats.Entries = len(ch.books) + len(ch.queries)
+	stats.Bytes = ch.size
+	ch.mu.Unlock()
+
+	return stats
+}
+
+// lookup returns e unless it is nil or has expired, in which case it is
+// dropped. ch.mu must be held.
+func (ch *CacheHandler) lookup(e *entry) (*entry, bool) {
+	if e == nil {
+		return nil, false
+	}
+
+	if time.Now().After(e.expiresAt) {
+		ch.remove(e, evictionExpired)
+		return nil, false
+	}
+
+	ch.policy.used(e)
+
+	return e, true
+}
+
+// addBook caches the book if it is not cached or its entry has expired.
+// ch.mu must be held.
+func (ch *CacheHandler) addBook(book domain.Book, now time.Time) bool {
+	if book.DeletedAt != nil {
+		return false
+	}
 
-	if val, err := ch.cache.Get(bookId); err == nil {
-		if cachedBook, ok := val.(domain.Book); ok {
-			book.ID = cachedBook.ID
-			book.PublishedAt = cachedBook.PublishedAt
+	if old, ok := ch.books[book.ID]; ok {
+		if now.Before(old.expiresAt) {
+			return false
+		}
+		ch.remove(old, evictionExpired)
+	}
+
+	e := &entry{id: book.ID, book: book, size: bookSize(book), expiresAt: now.Add(ch.cfg.BookTTL)}
+	ch.add(e)
+
+	return ch.books[book.ID] == e
+}
 
-			ch.cache.Set(bookId, book, cacheTTL)
-			log.WithField("id", id).Info("Cacher: UpdateCachedBook")
+// add stores e, then evicts other entries until the cache is within its
+// bounds: a new entry is never its own victim, or nothing new would be
+// cached once every entry was used. An entry larger than the whole cache
+// is not stored. ch.mu must be held.
+func (ch *CacheHandler) add(e *entry) {
+	if ch.cfg.MaxBytes > 0 && e.size > ch.cfg.MaxBytes {
+		return
+	}
+
+	if e.query != "" {
+		ch.queries[e.query] = e
+	} else {
+		ch.books[e.id] = e
+	}
+	ch.size += e.size
+	ch.policy.added(e)
+
+	for ch.overflows() {
+		victim := ch.policy.victim(e)
+		if victim == nil {
+			break
 		}
+		ch.remove(victim, evictionCapacity)
+	}
+}
+
+// remove drops e, counting it as evicted for reason unless reason is
+// empty. ch.mu must be held.
+func (ch *CacheHandler) remove(e *entry, reason string) {
+	if e.query != "" {
+		delete(ch.queries, e.query)
+	} else {
+		delete(ch.books, e.id)
+	}
+	ch.size -= e.size
+	ch.policy.removed(e)
+
+	if reason != "" {
+		ch.counters.CacheEviction(reason)
 	}
 }
 
-func (ch *CacheHandler) UpdateCacher() {
-	allBooksCached = false
+func (ch *CacheHandler) overflows() bool {
+	return (ch.cfg.MaxEntries > 0 && len(ch.books)+len(ch.queries) > ch.cfg.MaxEntries) ||
+		(ch.cfg.MaxBytes > 0 && ch.size > ch.cfg.MaxBytes)
+}
+
+// bookSize estimates the memory a cached book takes, entry bookkeeping
+// included.
+func bookSize(b domain.Book) int64 {
+	size := 256 + len(b.Name) + len(b.Description) + len(b.Author)
+	for _, genre := range b.Genres {
+		size += 16 + len(genre)
+	}
+
+	return int64(size)
+}
+
+func pageSize(page domain.BookPage) int64 {
+	size := int64(256 + len(page.NextCursor))
+	for _, book := range page.Books {
+		size += bookSize(book)
+	}
+
+	return size
 }
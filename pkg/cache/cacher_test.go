@@ -0,0 +1,304 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	log "github.com/sirupsen/logrus"
+)
+
+type nopMetrics struct{}
+
+func (nopMetrics) CacheHit(string)      {}
+func (nopMetrics) CacheMiss(string)     {}
+func (nopMetrics) CacheEviction(string) {}
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.WarnLevel)
+	os.Exit(m.Run())
+}
+
+func newTestCache(t *testing.T, policy string, maxEntries int) *CacheHandler {
+	t.Helper()
+
+	ch, err := NewCacheHandler(MemoryConfig{
+		BookTTL:    time.Hour,
+		ListTTL:    time.Hour,
+		Policy:     policy,
+		MaxEntries: maxEntries,
+		MaxBytes:   64 << 10,
+	}, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ch
+}
+
+func testBook(id int) domain.Book {
+	return domain.Book{
+		ID:          id,
+		Name:        fmt.Sprintf("Book %d", id),
+		Description: "Description",
+		Author:      "Author",
+		Genres:      []string{"Genre"},
+	}
+}
+
+// TestCacheHandlerConcurrent runs every operation from many goroutines, for
+// the race detector, then checks the bookkeeping still adds up.
+func TestCacheHandlerConcurrent(t *testing.T) {
+	for _, policy := range []string{PolicyLRU, PolicyLFU} {
+		t.Run(policy, func(t *testing.T) {
+			ch := newTestCache(t, policy, 50)
+			ctx := context.Background()
+
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+
+					for i := 0; i < 500; i++ {
+						id := (g*31 + i) % 80
+						q := domain.BookQuery{Limit: 10, Author: fmt.Sprintf("Author %d", id%5)}
+
+						switch i % 7 {
+						case 0:
+							ch.AddBook(ctx, 0, testBook(id))
+						case 1:
+							ch.GetCachedBook(ctx, id)
+						case 2:
+							ch.UpdateCachedBook(ctx, id, testBook(id))
+						case 3:
+							ch.AddBooks(ctx, q, 0, domain.BookPage{Books: []domain.Book{testBook(id), testBook(id + 1)}})
+						case 4:
+							ch.GetCachedBooks(ctx, q)
+						case 5:
+							ch.UpdateCacher(ctx)
+						case 6:
+							ch.DeleteCachedBook(ctx, id)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			ch.mu.Lock()
+			defer ch.mu.Unlock()
+
+			if n := len(ch.books) + len(ch.queries); n > 50 {
+				t.Errorf("%d entries cached, bound is 50", n)
+			}
+
+			var size int64
+			for _, e := range ch.books {
+				size += e.size
+			}
+			for _, e := range ch.queries {
+				size += e.size
+			}
+			if size != ch.size {
+				t.Errorf("size is %d, entries add up to %d", ch.size, size)
+			}
+		})
+	}
+}
+
+func TestCacheHandlerUpdateCacher(t *testing.T) {
+	ch := newTestCache(t, PolicyLRU, 0)
+	ctx := context.Background()
+	q := domain.BookQuery{Limit: 10}
+
+	ch.AddBooks(ctx, q, 0, domain.BookPage{Books: []domain.Book{testBook(1)}})
+	ch.UpdateCacher(ctx)
+
+	if _, _, err := ch.GetCachedBooks(ctx, q); !errors.Is(err, ErrNotCached) {
+		t.Errorf("listing is cached after UpdateCacher, err %v", err)
+	}
+	if _, _, err := ch.GetCachedBook(ctx, 1); err != nil {
+		t.Errorf("book of the listing is dropped by UpdateCacher: %v", err)
+	}
+}
+
+// cachedIDs lists which of the books 1 to n are cached.
+func cachedIDs(ch *CacheHandler, n int) []int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	var ids []int
+	for id := 1; id <= n; id++ {
+		if _, ok := ch.books[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+func TestCacheHandlerEviction(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		// reads are the books read after 1, 2 and 3 are added
+		reads []int
+		want  []int
+	}{
+		{
+			name:   "lru evicts the least recently used",
+			policy: PolicyLRU,
+			reads:  []int{1, 3, 2},
+			want:   []int{2, 3, 4},
+		},
+		{
+			name:   "lru evicts the oldest unread",
+			policy: PolicyLRU,
+			want:   []int{2, 3, 4},
+		},
+		{
+			name:   "lfu evicts the least frequently used",
+			policy: PolicyLFU,
+			reads:  []int{1, 1, 3, 3, 2},
+			want:   []int{1, 3, 4},
+		},
+		{
+			name:   "lfu breaks ties by recency",
+			policy: PolicyLFU,
+			reads:  []int{3, 1, 2},
+			want:   []int{1, 2, 4},
+		},
+		{
+			name:   "lfu admits a new book when all were read",
+			policy: PolicyLFU,
+			reads:  []int{1, 2, 3, 1, 2, 3},
+			want:   []int{2, 3, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := newTestCache(t, tt.policy, 3)
+			ctx := context.Background()
+
+			for id := 1; id <= 3; id++ {
+				ch.AddBook(ctx, 0, testBook(id))
+			}
+			for _, id := range tt.reads {
+				if _, _, err := ch.GetCachedBook(ctx, id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ch.AddBook(ctx, 0, testBook(4))
+
+			if got := cachedIDs(ch, 4); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("cached %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCacheHandlerAdmitsAfterWarmUp checks that once every entry of a full
+// cache was read, new books are still cached.
+func TestCacheHandlerAdmitsAfterWarmUp(t *testing.T) {
+	for _, policy := range []string{PolicyLRU, PolicyLFU} {
+		t.Run(policy, func(t *testing.T) {
+			ch := newTestCache(t, policy, 3)
+			ctx := context.Background()
+
+			for id := 1; id <= 3; id++ {
+				ch.AddBook(ctx, 0, testBook(id))
+				ch.GetCachedBook(ctx, id)
+			}
+
+			for id := 4; id <= 10; id++ {
+				ch.AddBook(ctx, 0, testBook(id))
+
+				if _, _, err := ch.GetCachedBook(ctx, id); err != nil {
+					t.Fatalf("book %d not cached: %v", id, err)
+				}
+			}
+
+			q := domain.BookQuery{Limit: 10}
+			ch.AddBooks(ctx, q, 0, domain.BookPage{})
+
+			if _, _, err := ch.GetCachedBooks(ctx, q); err != nil {
+				t.Errorf("listing not cached: %v", err)
+			}
+		})
+	}
+}
+
+// TestCacheHandlerLFUAging checks that books read often long ago do not
+// keep out the ones read now.
+func TestCacheHandlerLFUAging(t *testing.T) {
+	ch := newTestCache(t, PolicyLFU, 3)
+	ctx := context.Background()
+
+	for id := 1; id <= 3; id++ {
+		ch.AddBook(ctx, 0, testBook(id))
+	}
+	for i := 0; i < 100; i++ {
+		ch.GetCachedBook(ctx, 1)
+	}
+
+	// books 4 and up are each read a few times, book 1 no more
+	for id := 4; id <= 40; id++ {
+		ch.AddBook(ctx, 0, testBook(id))
+		for i := 0; i < 4; i++ {
+			ch.GetCachedBook(ctx, id)
+		}
+	}
+
+	if _, _, err := ch.GetCachedBook(ctx, 1); !errors.Is(err, ErrNotCached) {
+		t.Errorf("book read often long ago is still cached, err %v", err)
+	}
+}
+
+func TestCacheHandlerMaxBytes(t *testing.T) {
+	ch, err := NewCacheHandler(MemoryConfig{
+		BookTTL:  time.Hour,
+		ListTTL:  time.Hour,
+		Policy:   PolicyLRU,
+		MaxBytes: 3 * bookSize(testBook(1)),
+	}, nopMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for id := 1; id <= 4; id++ {
+		ch.AddBook(ctx, 0, testBook(id))
+	}
+
+	if got := cachedIDs(ch, 4); fmt.Sprint(got) != "[2 3 4]" {
+		t.Errorf("cached %v, want [2 3 4]", got)
+	}
+
+	large := testBook(5)
+	large.Description = strings.Repeat("x", int(bookSize(testBook(1))/2))
+	ch.AddBook(ctx, 0, large)
+
+	if got := cachedIDs(ch, 5); fmt.Sprint(got) != "[4 5]" {
+		t.Errorf("cached %v after a large book, want [4 5]", got)
+	}
+
+	huge := testBook(6)
+	huge.Description = strings.Repeat("x", int(4*bookSize(testBook(1))))
+	ch.AddBook(ctx, 0, huge)
+
+	if got := cachedIDs(ch, 6); fmt.Sprint(got) != "[4 5]" {
+		t.Errorf("cached %v after a book larger than the cache, want [4 5]", got)
+	}
+
+	stats := ch.Stats(ctx)
+	if stats.Bytes > ch.cfg.MaxBytes {
+		t.Errorf("%d bytes cached, bound is %d", stats.Bytes, ch.cfg.MaxBytes)
+	}
+}
@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackietana/crud-app/internal/domain"
+)
+
+// NopCache caches nothing, every read goes to the database.
+type NopCache struct{}
+
+func (NopCache) GetCachedBooks(_ context.Context, q domain.BookQuery) (domain.BookPage, int64, error) {
+	return domain.BookPage{}, 0, fmt.Errorf("%s: %w", q.CacheKey(), ErrNotCached)
+}
+
+func (NopCache) AddBooks(context.Context, domain.BookQuery, int64, domain.BookPage) {}
+
+func (NopCache) GetCachedBook(_ context.Context, id int) (domain.Book, int64, error) {
+	return domain.Book{}, 0, fmt.Errorf("book_%d: %w", id, ErrNotCached)
+}
+
+func (NopCache) AddBook(context.Context, int64, domain.Book) {}
+
+func (NopCache) UpdateCachedBook(context.Context, int, domain.Book) {}
+
+func (NopCache) DeleteCachedBook(context.Context, int) {}
+
+func (NopCache) UpdateCacher(context.Context) {}
+
+func (NopCache) Flush(context.Context) error {
+	return nil
+}
+
+func (NopCache) Stats(context.Context) domain.CacheStats {
+	return domain.CacheStats{Backend: "none", Evictions: map[string]uint64{}}
+}
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+const (
+	PolicyLRU = "lru"
+	PolicyLFU = "lfu"
+)
+
+// evictionPolicy picks the entry to evict when the memory cache is full.
+// Its methods are called with the cache lock held.
+type evictionPolicy interface {
+	added(e *entry)
+	used(e *entry)
+	removed(e *entry)
+	// victim returns the entry to evict next other than keep, the one
+	// being added, nil when there is none
+	victim(keep *entry) *entry
+}
+
+func newEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case PolicyLRU:
+		return &lruPolicy{list.New()}, nil
+	case PolicyLFU:
+		return new(lfuPolicy), nil
+	}
+
+	return nil, fmt.Errorf("unknown cache eviction policy %q", name)
+}
+
+// lruPolicy evicts the least recently used entry.
+type lruPolicy struct {
+	entries *list.List
+}
+
+func (p *lruPolicy) added(e *entry) {
+	e.elem = p.entries.PushFront(e)
+}
+
+func (p *lruPolicy) used(e *entry) {
+	p.entries.MoveToFront(e.elem)
+}
+
+func (p *lruPolicy) removed(e *entry) {
+	p.entries.Remove(e.elem)
+}
+
+func (p *lruPolicy) victim(keep *entry) *entry {
+	for elem := p.entries.Back(); elem != nil; elem = elem.Prev() {
+		if e := elem.Value.(*entry); e != keep {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// lfuAgingFactor sets how often LFU use counts are halved: once per that
+// many uses per entry.
+const lfuAgingFactor = 8
+
+// lfuPolicy evicts the least frequently used entry, the least recently
+// used of those on a tie. Use counts are halved now and then, so entries
+// popular long ago do not keep out new ones for good.
+type lfuPolicy struct {
+	entries lfuHeap
+	clock   uint64
+	// sinceAging counts the uses since counts were last halved
+	sinceAging int
+}
+
+func (p *lfuPolicy) added(e *entry) {
+	// storing counts as a use, so a new entry is not the first to go
+	// while older ones were never read
+	p.clock++
+	e.uses, e.lastUse = 1, p.clock
+	heap.Push(&p.entries, e)
+}
+
+func (p *lfuPolicy) used(e *entry) {
+	p.clock++
+	e.uses++
+	e.lastUse = p.clock
+	heap.Fix(&p.entries, e.index)
+
+	if p.sinceAging++; p.sinceAging >= lfuAgingFactor*len(p.entries) {
+		p.age()
+	}
+}
+
+// age halves every use count. Halving keeps the order of the counts, the
+// heap is rebuilt for the ties it makes.
+func (p *lfuPolicy) age() {
+	for _, e := range p.entries {
+		e.uses /= 2
+	}
+	heap.Init(&p.entries)
+
+	p.sinceAging = 0
+}
+
+func (p *lfuPolicy) removed(e *entry) {
+	heap.Remove(&p.entries, e.index)
+}
+
+func (p *lfuPolicy) victim(keep *entry) *entry {
+	h := p.entries
+	if len(h) == 0 {
+		return nil
+	}
+
+	if h[0] != keep {
+		return h[0]
+	}
+
+	// keep is the least used; the next one is one of its children
+	switch {
+	case len(h) == 1:
+		return nil
+	case len(h) == 2 || h.Less(1, 2):
+		return h[1]
+	default:
+		return h[2]
+	}
+}
+
+// lfuHeap is a min-heap of entries by use count, then by last use.
+type lfuHeap []*entry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].uses != h[j].uses {
+		return h[i].uses < h[j].uses
+	}
+
+	return h[i].lastUse < h[j].lastUse
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return e
+}
@@ -0,0 +1,396 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackietana/crud-app/internal/domain"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+type RedisConfig struct {
+	Address   string
+	Password  string
+	DB        int
+	KeyPrefix string
+	BookTTL   time.Duration
+	ListTTL   time.Duration
+	Timeout   time.Duration
+}
+
+// RedisCache keeps books in Redis, or anything speaking its protocol, so
+// all replicas read and invalidate the same entries. Values are stored as
+// JSON under these keys, after the configured prefix:
+//
+//	book:<id>                  a single book
+//	books:gen                  the listing generation
+//	books:<gen>:<query key>    a page of a listing
+//
+// Listings are invalidated by bumping the generation; pages of older
+// generations are never read again and expire with the TTL. Lookups
+// return the generation they saw and fills are stored only if it has not
+// changed since, so a read that raced a write on another replica is not
+// cached.
+//
+// Redis errors are logged and treated as misses, the database stays the
+// source of truth. Redis bounds its memory itself, with maxmemory and
+// maxmemory-policy.
+type RedisCache struct {
+	client   *redis.Client
+	prefix   string
+	bookTTL  time.Duration
+	listTTL  time.Duration
+	counters *counters
+}
+
+func NewRedisCache(cfg RedisConfig, metrics Metrics) *RedisCache {
+	client := redis.NewClient(&redis.Options{
+		Addr:         cfg.Address,
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		DialTimeout:  cfg.Timeout,
+		ReadTimeout:  cfg.Timeout,
+		WriteTimeout: cfg.Timeout,
+	})
+
+	return &RedisCache{client, cfg.KeyPrefix, cfg.BookTTL, cfg.ListTTL, newCounters(metrics)}
+}
+
+// Check pings the server, for readiness checks.
+func (rc *RedisCache) Check(ctx context.Context) error {
+	return rc.client.Ping(ctx).Err()
+}
+
+func (rc *RedisCache) Close() error {
+	return rc.client.Close()
+}
+
+// GetCachedBooks also returns the listing generation, on a miss the one
+// to pass to AddBooks.
+func (rc *RedisCache) GetCachedBooks(ctx context.Context, q domain.BookQuery) (domain.BookPage, int64, error) {
+	var page domain.BookPage
+
+	gen, err := rc.generation(ctx)
+	if err == nil {
+		err = rc.get(ctx, rc.queryKey(gen, q), &page)
+	}
+	if err != nil {
+		rc.counters.CacheMiss(kindQuery)
+		return domain.BookPage{}, gen, err
+	}
+
+	rc.counters.CacheHit(kindQuery)
+	log.WithField("query", q.CacheKey()).Info("Cacher: GetCachedBooks")
+
+	return page, gen, nil
+}
+
+// AddBooks caches the page and its books, unless the listings were
+// invalidated since gen was read.
+func (rc *RedisCache) AddBooks(ctx context.Context, q domain.BookQuery, gen int64, page domain.BookPage) {
+	data, err := json.Marshal(page)
+	if err != nil {
+		rc.logError("AddBooks", err)
+		return
+	}
+
+	var f fill
+	for _, book := range page.Books {
+		if err := rc.fillBook(&f, book); err != nil {
+			rc.logError("AddBooks", err)
+			return
+		}
+	}
+	f.add(rc.queryKey(gen, q), data, rc.listTTL, false)
+
+	if err := rc.fill(ctx, gen, f); err != nil {
+		rc.logError("AddBooks", err)
+	}
+}
+
+// GetCachedBook also returns the listing generation, on a miss the one to
+// pass to AddBook. Both are read in one round trip.
+func (rc *RedisCache) GetCachedBook(ctx context.Context, id int) (domain.Book, int64, error) {
+	var book domain.Book
+
+	key := rc.bookKey(id)
+	values, err := rc.client.MGet(ctx, key, rc.genKey()).Result()
+	if err != nil {
+		rc.logError("GetCachedBook", err)
+		rc.counters.CacheMiss(kindBook)
+		return domain.Book{}, 0, fmt.Errorf("%s: %w", key, ErrNotCached)
+	}
+
+	var gen int64
+	if s, ok := values[1].(string); ok {
+		if gen, err = strconv.ParseInt(s, 10, 64); err != nil {
+			rc.logError("GetCachedBook", err)
+		}
+	}
+
+	data, ok := values[0].(string)
+	if !ok {
+		rc.counters.CacheMiss(kindBook)
+		return domain.Book{}, gen, fmt.Errorf("%s: %w", key, ErrNotCached)
+	}
+
+	if err := json.Unmarshal([]byte(data), &book); err != nil {
+		rc.logError("GetCachedBook", err)
+		rc.counters.CacheMiss(kindBook)
+		return domain.Book{}, gen, fmt.Errorf("%s: %w", key, ErrNotCached)
+	}
+
+	rc.counters.CacheHit(kindBook)
+	log.WithField("id", id).Info("Cacher: GetCachedBook")
+
+	return book, gen, nil
+}
+
+// AddBook caches the book unless it is in the trash or already cached, or
+// a write, on any replica, bumped the generation since gen was read.
+func (rc *RedisCache) AddBook(ctx context.Context, gen int64, book domain.Book) {
+	var f fill
+	if err := rc.fillBook(&f, book); err != nil {
+		rc.logError("AddBook", err)
+		return
+	}
+
+	if err := rc.fill(ctx, gen, f); err != nil {
+		rc.logError("AddBook", err)
+	}
+}
+
+// UpdateCachedBook replaces a cached book, it does not cache one that is
+// not cached yet. A book moved to the trash is dropped instead.
+func (rc *RedisCache) UpdateCachedBook(ctx context.Context, id int, book domain.Book) {
+	if book.DeletedAt != nil {
+		rc.DeleteCachedBook(ctx, id)
+		return
+	}
+
+	data, err := json.Marshal(book)
+	if err != nil {
+		rc.logError("UpdateCachedBook", err)
+		return
+	}
+
+	if err := rc.client.SetXX(ctx, rc.bookKey(id), data, rc.bookTTL).Err(); err != nil {
+		rc.logError("UpdateCachedBook", err)
+	}
+}
+
+func (rc *RedisCache) DeleteCachedBook(ctx context.Context, id int) {
+	n, err := rc.client.Del(ctx, rc.bookKey(id)).Result()
+	if err != nil {
+		rc.logError("DeleteCachedBook", err)
+		return
+	}
+
+	if n > 0 {
+		rc.counters.CacheEviction(evictionInvalidated)
+		log.WithField("id", id).Info("Cacher: DeleteCachedBook")
+	}
+}
+
+// UpdateCacher drops every cached listing, on all replicas.
+func (rc *RedisCache) UpdateCacher(ctx context.Context) {
+	if err := rc.client.Incr(ctx, rc.genKey()).Err(); err != nil {
+		rc.logError("UpdateCacher", err)
+		return
+	}
+
+	rc.counters.CacheEviction(evictionInvalidated)
+}
+
+// Flush drops every book and listing under the prefix, for all replicas.
+// The keys are collected before any is dropped: a cursor is not guaranteed
+// to survive deletions by every server speaking the protocol.
+func (rc *RedisCache) Flush(ctx context.Context) error {
+	iter := rc.client.Scan(ctx, 0, rc.prefix+"*", 1000).Iterator()
+
+	var keys []string
+	for iter.Next(ctx) {
+		// the generation is bumped rather than dropped: reset to 0, it
+		// could match the one a fill in flight started at
+		if iter.Val() != rc.genKey() {
+			keys = append(keys, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	if err := rc.client.Incr(ctx, rc.genKey()).Err(); err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		n := min(len(keys), 1000)
+		if err := rc.unlink(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+
+	log.Info("Cacher: Flush")
+
+	return nil
+}
+
+// Stats reports the lookups and evictions of this instance, Redis keeps
+// the entries of all of them.
+func (rc *RedisCache) Stats(_ context.Context) domain.CacheStats {
+	return rc.counters.stats("redis")
+}
+
+func (rc *RedisCache) unlink(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	n, err := rc.client.Unlink(ctx, keys...).Result()
+	for i := int64(0); i < n; i++ {
+		rc.counters.CacheEviction(evictionFlushed)
+	}
+
+	return err
+}
+
+// fillScript stores the values of a fill if the generation, KEYS[1], is
+// still ARGV[1]. KEYS[2:] are the keys to set; ARGV[2:] holds a value, a
+// TTL in milliseconds (0 for none) and "NX" or "" for each of them.
+//
+// Every write bumps the generation before it drops the entries it
+// changed. A fill that read the database before a write is then either
+// refused here or stored before the write drops it, on any replica.
+var fillScript = redis.NewScript(`
+local gen = redis.call('GET', KEYS[1]) or '0'
+if gen ~= ARGV[1] then
+	return 0
+end
+
+for i = 2, #KEYS do
+	local j = 2 + (i - 2) * 3
+	local args = {'SET', KEYS[i], ARGV[j]}
+	if ARGV[j + 1] ~= '0' then
+		table.insert(args, 'PX')
+		table.insert(args, ARGV[j + 1])
+	end
+	if ARGV[j + 2] == 'NX' then
+		table.insert(args, 'NX')
+	end
+	redis.call(unpack(args))
+end
+
+return 1
+`)
+
+// fill collects the keys and arguments of fillScript.
+type fill struct {
+	keys []string
+	args []interface{}
+}
+
+func (f *fill) add(key string, data []byte, ttl time.Duration, nx bool) {
+	mode := ""
+	if nx {
+		mode = "NX"
+	}
+
+	f.keys = append(f.keys, key)
+	f.args = append(f.args, data, ttl.Milliseconds(), mode)
+}
+
+// fillBook adds a book to f, without replacing a cached one. Books in the
+// trash are not cached.
+func (rc *RedisCache) fillBook(f *fill, book domain.Book) error {
+	if book.DeletedAt != nil {
+		return nil
+	}
+
+	data, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+
+	f.add(rc.bookKey(book.ID), data, rc.bookTTL, true)
+
+	return nil
+}
+
+func (rc *RedisCache) fill(ctx context.Context, gen int64, f fill) error {
+	if len(f.keys) == 0 {
+		return nil
+	}
+
+	keys := append([]string{rc.genKey()}, f.keys...)
+	args := append([]interface{}{strconv.FormatInt(gen, 10)}, f.args...)
+
+	stored, err := fillScript.Run(ctx, rc.client, keys, args...).Int()
+	if err != nil {
+		return err
+	}
+
+	if stored == 0 {
+		log.WithField("generation", gen).Info("Cacher: fill skipped, the cache was invalidated since the miss")
+	}
+
+	return nil
+}
+
+// generation returns the current listing generation, 0 before the first
+// invalidation.
+func (rc *RedisCache) generation(ctx context.Context) (int64, error) {
+	gen, err := rc.client.Get(ctx, rc.genKey()).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		rc.logError("generation", err)
+	}
+
+	return gen, err
+}
+
+// get decodes the value of key into v. A missing key or a failed lookup
+// is reported as ErrNotCached.
+func (rc *RedisCache) get(ctx context.Context, key string, v interface{}) error {
+	data, err := rc.client.Get(ctx, key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			rc.logError("get", err)
+		}
+		return fmt.Errorf("%s: %w", key, ErrNotCached)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		rc.logError("get", err)
+		return fmt.Errorf("%s: %w", key, ErrNotCached)
+	}
+
+	return nil
+}
+
+func (rc *RedisCache) genKey() string {
+	return rc.prefix + "books:gen"
+}
+
+func (rc *RedisCache) bookKey(id int) string {
+	return rc.prefix + "book:" + strconv.Itoa(id)
+}
+
+func (rc *RedisCache) queryKey(gen int64, q domain.BookQuery) string {
+	return rc.prefix + "books:" + strconv.FormatInt(gen, 10) + ":" + q.CacheKey()
+}
+
+func (rc *RedisCache) logError(op string, err error) {
+	log.WithFields(log.Fields{
+		"cache": "redis",
+		"op":    op,
+	}).Warn(err)
+}
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jackietana/crud-app/internal/domain"
+)
+
+func newTestRedisCache(t *testing.T) (*RedisCache, *miniredis.Miniredis) {
+	t.Helper()
+
+	srv := miniredis.RunT(t)
+	rc := NewRedisCache(RedisConfig{
+		Address:   srv.Addr(),
+		KeyPrefix: "test:",
+		BookTTL:   time.Hour,
+		ListTTL:   time.Minute,
+		Timeout:   time.Second,
+	}, nopMetrics{})
+	t.Cleanup(func() { rc.Close() })
+
+	return rc, srv
+}
+
+func TestRedisCacheGenerationBump(t *testing.T) {
+	rc, srv := newTestRedisCache(t)
+	ctx := context.Background()
+	q := domain.BookQuery{Limit: 10}
+	page := domain.BookPage{Books: []domain.Book{testBook(1)}, Total: 1, Limit: 10}
+
+	_, gen, _ := rc.GetCachedBooks(ctx, q)
+	rc.AddBooks(ctx, q, gen, page)
+
+	got, _, err := rc.GetCachedBooks(ctx, q)
+	if err != nil {
+		t.Fatalf("listing not cached: %v", err)
+	}
+	if len(got.Books) != 1 || got.Books[0].ID != 1 {
+		t.Errorf("cached listing is %+v", got)
+	}
+	if !srv.Exists("test:books:0:" + q.CacheKey()) {
+		t.Errorf("listing not stored under generation 0, keys %v", srv.Keys())
+	}
+
+	rc.UpdateCacher(ctx)
+
+	if gen, _ := srv.Get("test:books:gen"); gen != "1" {
+		t.Errorf("generation is %q after UpdateCacher, want 1", gen)
+	}
+	if _, _, err := rc.GetCachedBooks(ctx, q); !errors.Is(err, ErrNotCached) {
+		t.Errorf("listing of the old generation is read, err %v", err)
+	}
+	if _, _, err := rc.GetCachedBook(ctx, 1); err != nil {
+		t.Errorf("book of the listing is dropped by UpdateCacher: %v", err)
+	}
+
+	_, gen, _ = rc.GetCachedBooks(ctx, q)
+	rc.AddBooks(ctx, q, gen, page)
+
+	if !srv.Exists("test:books:1:" + q.CacheKey()) {
+		t.Errorf("listing not stored under generation 1, keys %v", srv.Keys())
+	}
+	if ttl := srv.TTL("test:books:1:" + q.CacheKey()); ttl != time.Minute {
+		t.Errorf("listing TTL is %v, want %v", ttl, time.Minute)
+	}
+}
+
+// TestRedisCacheStaleFill checks that a fill is not stored when the
+// generation was bumped, by any replica, between the miss and the fill.
+func TestRedisCacheStaleFill(t *testing.T) {
+	rc, srv := newTestRedisCache(t)
+	ctx := context.Background()
+	q := domain.BookQuery{Limit: 10}
+	page := domain.BookPage{Books: []domain.Book{testBook(1)}, Total: 1, Limit: 10}
+
+	_, listGen, err := rc.GetCachedBooks(ctx, q)
+	if !errors.Is(err, ErrNotCached) {
+		t.Fatalf("listing cached before any fill, err %v", err)
+	}
+	_, bookGen, err := rc.GetCachedBook(ctx, 2)
+	if !errors.Is(err, ErrNotCached) {
+		t.Fatalf("book cached before any fill, err %v", err)
+	}
+
+	// a write on another replica, while the database was read
+	if _, err := srv.Incr("test:books:gen", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	rc.AddBooks(ctx, q, listGen, page)
+	rc.AddBook(ctx, bookGen, testBook(2))
+
+	if keys := srv.Keys(); len(keys) != 1 {
+		t.Errorf("stale fills stored, keys %v", keys)
+	}
+
+	_, listGen, _ = rc.GetCachedBooks(ctx, q)
+	_, bookGen, _ = rc.GetCachedBook(ctx, 2)
+	if listGen != 1 || bookGen != 1 {
+		t.Fatalf("lookups saw generations %d and %d, want 1", listGen, bookGen)
+	}
+
+	rc.AddBooks(ctx, q, listGen, page)
+	rc.AddBook(ctx, bookGen, testBook(2))
+
+	if _, _, err := rc.GetCachedBooks(ctx, q); err != nil {
+		t.Errorf("listing not cached after a fresh fill: %v", err)
+	}
+	for _, id := range []int{1, 2} {
+		if _, _, err := rc.GetCachedBook(ctx, id); err != nil {
+			t.Errorf("book %d not cached after a fresh fill: %v", id, err)
+		}
+	}
+}
+
+func TestRedisCacheAddBookKeepsCached(t *testing.T) {
+	rc, srv := newTestRedisCache(t)
+	ctx := context.Background()
+
+	rc.AddBook(ctx, 0, testBook(1))
+
+	newer := testBook(1)
+	newer.Name = "Newer"
+	rc.AddBook(ctx, 0, newer)
+
+	got, _, err := rc.GetCachedBook(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Book 1" {
+		t.Errorf("AddBook replaced a cached book, name %q", got.Name)
+	}
+	if ttl := srv.TTL("test:book:1"); ttl != time.Hour {
+		t.Errorf("book TTL is %v, want %v", ttl, time.Hour)
+	}
+
+	trashed := testBook(2)
+	now := time.Now()
+	trashed.DeletedAt = &now
+	rc.AddBook(ctx, 0, trashed)
+
+	if srv.Exists("test:book:2") {
+		t.Error("AddBook cached a book in the trash")
+	}
+}
+
+func TestRedisCacheUpdateOnlyCached(t *testing.T) {
+	rc, srv := newTestRedisCache(t)
+	ctx := context.Background()
+
+	rc.UpdateCachedBook(ctx, 1, testBook(1))
+
+	if srv.Exists("test:book:1") {
+		t.Error("UpdateCachedBook cached a book that was not cached")
+	}
+
+	rc.AddBook(ctx, 0, testBook(2))
+
+	updated := testBook(2)
+	updated.Name = "Updated"
+	rc.UpdateCachedBook(ctx, 2, updated)
+
+	got, _, err := rc.GetCachedBook(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Updated" {
+		t.Errorf("UpdateCachedBook kept name %q", got.Name)
+	}
+
+	now := time.Now()
+	updated.DeletedAt = &now
+	rc.UpdateCachedBook(ctx, 2, updated)
+
+	if srv.Exists("test:book:2") {
+		t.Error("UpdateCachedBook kept a book moved to the trash")
+	}
+}
+
+func TestRedisCacheFlush(t *testing.T) {
+	rc, srv := newTestRedisCache(t)
+	ctx := context.Background()
+
+	srv.Set("other:book:1", "kept")
+	for id := 1; id <= 1500; id++ {
+		rc.AddBook(ctx, 0, testBook(id))
+	}
+	rc.AddBooks(ctx, domain.BookQuery{Limit: 10}, 0, domain.BookPage{})
+	rc.UpdateCacher(ctx)
+
+	if err := rc.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := srv.Keys()
+	if len(keys) != 2 || keys[0] != "other:book:1" || keys[1] != "test:books:gen" {
+		t.Errorf("keys left after Flush: %d, want the generation and the other prefix", len(keys))
+	}
+	if gen, _ := srv.Get("test:books:gen"); gen != "2" {
+		t.Errorf("generation is %q after Flush, want 2", gen)
+	}
+
+	stats := rc.Stats(ctx)
+	if stats.Evictions[evictionFlushed] != 1501 {
+		t.Errorf("%d flushed evictions, want 1501", stats.Evictions[evictionFlushed])
+	}
+}
+
+func TestRedisCacheErrorsAreMisses(t *testing.T) {
+	rc, srv := newTestRedisCache(t)
+	ctx := context.Background()
+
+	rc.AddBook(ctx, 0, testBook(1))
+	srv.Close()
+
+	if _, _, err := rc.GetCachedBook(ctx, 1); !errors.Is(err, ErrNotCached) {
+		t.Errorf("lookup with Redis down returned %v, want ErrNotCached", err)
+	}
+	if err := rc.Check(ctx); err == nil {
+		t.Error("Check passed with Redis down")
+	}
+}
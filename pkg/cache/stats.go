@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackietana/crud-app/internal/domain"
+)
+
+// counters counts cache events for the stats and passes them on to the
+// metrics.
+type counters struct {
+	metrics Metrics
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+
+	mu        sync.Mutex
+	evictions map[string]uint64
+}
+
+func newCounters(metrics Metrics) *counters {
+	return &counters{metrics: metrics, evictions: make(map[string]uint64)}
+}
+
+func (c *counters) CacheHit(kind string) {
+	c.hits.Add(1)
+	c.metrics.CacheHit(kind)
+}
+
+func (c *counters) CacheMiss(kind string) {
+	c.misses.Add(1)
+	c.metrics.CacheMiss(kind)
+}
+
+func (c *counters) CacheEviction(reason string) {
+	c.mu.Lock()
+	c.evictions[reason]++
+	c.mu.Unlock()
+
+	c.metrics.CacheEviction(reason)
+}
+
+func (c *counters) stats(backend string) domain.CacheStats {
+	stats := domain.CacheStats{
+		Backend:   backend,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: make(map[string]uint64),
+	}
+
+	c.mu.Lock()
+	for reason, n := range c.evictions {
+		stats.Evictions[reason] = n
+	}
+	c.mu.Unlock()
+
+	return stats
+}
@@ -9,9 +9,7 @@ import (
 )
 
 func ConnectDB(p *config.Postgres) (*sql.DB, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		p.Host, p.Port, p.User, p.Pass, p.Name)
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", ConnString(p))
 	if err != nil {
 		return nil, err
 	}
@@ -22,3 +20,10 @@ func ConnectDB(p *config.Postgres) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// ConnString is the lib/pq connection string for p, for connections made
+// outside the pool.
+func ConnString(p *config.Postgres) string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		p.Host, p.Port, p.User, p.Pass, p.Name)
+}
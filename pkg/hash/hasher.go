@@ -2,9 +2,13 @@ package hash
 
 import (
 	"crypto/sha1"
+	"crypto/subtle"
 	"fmt"
+	"strings"
 )
 
+// SHA1Hasher is the legacy unsalted scheme. It is kept only to verify
+// passwords stored before the adaptive hashers were introduced.
 type SHA1Hasher struct {
 	salt string
 }
@@ -22,3 +26,22 @@ func (h *SHA1Hasher) Hash(password string) (string, error) {
 
 	return fmt.Sprintf("%x", hash.Sum([]byte(h.salt))), nil
 }
+
+func (h *SHA1Hasher) Verify(password, encoded string) (bool, error) {
+	hash, err := h.Hash(password)
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(encoded)) == 1, nil
+}
+
+// NeedsRehash always reports true: SHA1 hashes must be upgraded.
+func (h *SHA1Hasher) NeedsRehash(encoded string) bool {
+	return true
+}
+
+// Identifies matches any hash without a scheme prefix.
+func (h *SHA1Hasher) Identifies(encoded string) bool {
+	return encoded != "" && !strings.HasPrefix(encoded, "$")
+}
@@ -0,0 +1,39 @@
+package hash
+
+// Scheme is a single password hashing algorithm. Identifies reports whether
+// an encoded hash was produced by the scheme.
+type Scheme interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	NeedsRehash(encoded string) bool
+	Identifies(encoded string) bool
+}
+
+// PasswordHasher hashes new passwords with the primary scheme and verifies
+// hashes of any known scheme, so stored hashes can be upgraded on sign in.
+type PasswordHasher struct {
+	primary Scheme
+	schemes []Scheme
+}
+
+func NewPasswordHasher(primary Scheme, legacy ...Scheme) *PasswordHasher {
+	return &PasswordHasher{primary, append([]Scheme{primary}, legacy...)}
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	return h.primary.Hash(password)
+}
+
+func (h *PasswordHasher) Verify(password, encoded string) (bool, error) {
+	for _, s := range h.schemes {
+		if s.Identifies(encoded) {
+			return s.Verify(password, encoded)
+		}
+	}
+
+	return false, ErrInvalidHash
+}
+
+func (h *PasswordHasher) NeedsRehash(encoded string) bool {
+	return !h.primary.Identifies(encoded) || h.primary.NeedsRehash(encoded)
+}